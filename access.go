@@ -0,0 +1,52 @@
+package sftp
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/models"
+	"github.com/oarkflow/sftp/pkg/providers"
+	"github.com/oarkflow/sftp/pkg/utils"
+)
+
+// validateIPLists makes sure the server wide allow and deny lists are valid CIDR blocks or IPs.
+func (c *Server) validateIPLists() error {
+	for _, list := range [][]string{c.allowedIPs, c.deniedIPs} {
+		if _, err := utils.MatchCIDRs(list, nil); err != nil {
+			return fmt.Errorf("invalid IP list: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkSourceIP enforces the server wide allow and deny lists and, when user is not nil, the
+// lists of that user. Denied attempts are logged and notified as failed logins.
+func (c *Server) checkSourceIP(conn ssh.ConnMetadata, user *models.User) error {
+	ip := utils.IP(conn.RemoteAddr())
+	allowed, err := models.IPAllowed(ip, c.allowedIPs, c.deniedIPs)
+	if err == nil && allowed && user != nil {
+		allowed, err = user.AllowsIP(ip)
+	}
+	if err == nil && allowed {
+		return nil
+	}
+	if err == nil {
+		err = errs.IPNotAllowedError{IP: ip.String()}
+	}
+	c.loginFailed(conn.User(), conn.RemoteAddr().String(), string(conn.ClientVersion()), err)
+	return errs.IPNotAllowedError{IP: ip.String()}
+}
+
+// getUser returns the effective user, with its groups merged in when the provider has any.
+func (c *Server) getUser(username string) (models.User, error) {
+	user, err := providers.GetUser(c.userProvider, username)
+	if err != nil {
+		return user, err
+	}
+	if resolver, ok := c.userProvider.(providers.GroupResolver); ok {
+		return resolver.ResolveUser(user)
+	}
+	return user, nil
+}
@@ -0,0 +1,251 @@
+package sftp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/providers"
+	"github.com/oarkflow/sftp/pkg/utils"
+)
+
+const sourceAddressOption = "source-address"
+
+// setupCertChecker loads the trusted user certificate authorities. It returns a nil checker
+// when no authority is configured.
+func (c *Server) setupCertChecker() (*ssh.CertChecker, error) {
+	if len(c.userCAKeys) == 0 {
+		return nil, nil
+	}
+	var authorities [][]byte
+	for _, file := range c.userCAKeys {
+		keys, err := readAuthorizedKeys(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			authorities = append(authorities, key.Marshal())
+		}
+	}
+	if len(authorities) == 0 {
+		return nil, errors.New("no user certificate authority keys found")
+	}
+	revocations := &revocationList{file: c.revocationList}
+	return &ssh.CertChecker{
+		SupportedCriticalOptions: []string{sourceAddressOption},
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			marshaled := auth.Marshal()
+			for _, authority := range authorities {
+				if bytes.Equal(authority, marshaled) {
+					return true
+				}
+			}
+			return false
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			revoked, err := revocations.isRevoked(cert)
+			if err != nil {
+				// Fail closed, a revocation list that cannot be read must not let certificates through.
+				c.logger.Error("failed to read certificate revocation list", "file", c.revocationList, "err", err)
+				return true
+			}
+			return revoked
+		},
+	}, nil
+}
+
+// validateCertificate authenticates a user certificate signed by a trusted authority. The
+// login user must be one of the certificate principals and must exist in the user provider.
+func (c *Server) validateCertificate(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if c.certChecker == nil {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.Allow(utils.IP(conn.RemoteAddr()).String(), conn.User()); err != nil {
+			return nil, err
+		}
+	}
+	perms, err := c.checkCertificate(conn, cert)
+	if err != nil {
+		c.logger.Warn("certificate rejected",
+			"user", conn.User(),
+			"remote_addr", conn.RemoteAddr().String(),
+			"key_id", cert.KeyId,
+			"serial", cert.Serial,
+			"err", err,
+		)
+		c.keyFailed(conn)
+		return nil, errs.InvalidCredentialsError{}
+	}
+	// The ssh package only enforces source-address once authentication fully succeeded, which
+	// is not the case when a second factor is requested, so it is checked here as well.
+	if addresses := perms.CriticalOptions[sourceAddressOption]; addresses != "" {
+		allowed, err := utils.MatchCIDRs(strings.Split(addresses, ","), utils.IP(conn.RemoteAddr()))
+		if err != nil || !allowed {
+			c.logger.Warn("certificate used from a disallowed source address",
+				"user", conn.User(),
+				"remote_addr", conn.RemoteAddr().String(),
+				"key_id", cert.KeyId,
+			)
+			c.keyFailed(conn)
+			return nil, errs.InvalidCredentialsError{}
+		}
+	}
+	user, err := c.getUser(conn.User())
+	if err != nil {
+		if !errs.IsUserNotFoundError(err) {
+			c.logger.Error("failed to look up the certificate user", "user", conn.User(), "err", err)
+		}
+		c.keyFailed(conn)
+		return nil, errs.InvalidCredentialsError{}
+	}
+	if err := c.checkSourceIP(conn, &user); err != nil {
+		return nil, err
+	}
+	if err := user.CheckStatus(time.Now()); err != nil {
+		return nil, err
+	}
+	return c.secondFactor(conn, "publickey", providers.NewAuthenticationResponse(user))
+}
+
+// checkCertificate verifies cert with the certificate checker for the login user. The user
+// must be listed in the principals: the checker accepts certificates without principals for
+// every user, which would let them log in as anyone.
+func (c *Server) checkCertificate(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if !slices.Contains(cert.ValidPrincipals, conn.User()) {
+		return nil, fmt.Errorf("user %q is not a principal of the certificate", conn.User())
+	}
+	return c.certChecker.Authenticate(conn, cert)
+}
+
+// loadHostCertificate wraps the host key the configured host certificate was issued for.
+func (c *Server) loadHostCertificate(signers []ssh.Signer) (ssh.Signer, error) {
+	data, err := os.ReadFile(c.getSSHPath(c.hostCertificate))
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%s is not a host certificate", c.hostCertificate)
+	}
+	marshaled := cert.Key.Marshal()
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), marshaled) {
+			return ssh.NewCertSigner(cert, signer)
+		}
+	}
+	return nil, fmt.Errorf("%s was not issued for any of the host keys", c.hostCertificate)
+}
+
+func readAuthorizedKeys(file string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+// revocationList is a text file listing revoked certificates, reloaded whenever it changes.
+// Each line is either a public key in authorized_keys format, revoking certificates for that
+// key or signed by it, "serial:<n>" revoking a certificate serial, or "id:<key id>" revoking
+// a certificate key ID. Empty lines and lines starting with # are ignored.
+type revocationList struct {
+	file    string
+	mu      sync.Mutex
+	modTime time.Time
+	keys    [][]byte
+	serials map[uint64]struct{}
+	ids     map[string]struct{}
+}
+
+func (l *revocationList) isRevoked(cert *ssh.Certificate) (bool, error) {
+	if l.file == "" {
+		return false, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reload(); err != nil {
+		return false, err
+	}
+	if _, ok := l.serials[cert.Serial]; ok {
+		return true, nil
+	}
+	if _, ok := l.ids[cert.KeyId]; ok {
+		return true, nil
+	}
+	key := cert.Key.Marshal()
+	signer := cert.SignatureKey.Marshal()
+	for _, revoked := range l.keys {
+		if bytes.Equal(revoked, key) || bytes.Equal(revoked, signer) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (l *revocationList) reload() error {
+	stat, err := os.Stat(l.file)
+	if err != nil {
+		return err
+	}
+	if stat.ModTime().Equal(l.modTime) {
+		return nil
+	}
+	file, err := os.Open(l.file)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var keys [][]byte
+	serials := make(map[uint64]struct{})
+	ids := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "serial:"):
+			serial, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "serial:")), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: invalid serial: %w", l.file, err)
+			}
+			serials[serial] = struct{}{}
+		case strings.HasPrefix(line, "id:"):
+			ids[strings.TrimSpace(strings.TrimPrefix(line, "id:"))] = struct{}{}
+		default:
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				return fmt.Errorf("%s: %w", l.file, err)
+			}
+			keys = append(keys, key.Marshal())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	l.keys, l.serials, l.ids, l.modTime = keys, serials, ids, stat.ModTime()
+	return nil
+}
@@ -0,0 +1,64 @@
+package sftp
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// signCertificate issues a user certificate for key, signed by authority.
+func signCertificate(t *testing.T, authority, key ssh.Signer, principals ...string) ssh.AuthMethod {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.PublicKeys(signer)
+}
+
+func TestCertificatePrincipals(t *testing.T) {
+	authority := newTestSigner(t)
+	caFile := filepath.Join(t.TempDir(), "user_ca.pub")
+	if err := os.WriteFile(caFile, ssh.MarshalAuthorizedKey(authority.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, []models.User{
+		{Username: "alice", Permissions: []string{"read"}},
+		{Username: "bob", Permissions: []string{"read"}},
+	}, WithUserCAKeys(caFile))
+	key := newTestSigner(t)
+
+	for _, tt := range []struct {
+		name string
+		user string
+		auth ssh.AuthMethod
+		ok   bool
+	}{
+		{"listed principal", "alice", signCertificate(t, authority, key, "alice"), true},
+		{"other principal", "bob", signCertificate(t, authority, key, "alice"), false},
+		{"no principals", "alice", signCertificate(t, authority, key), false},
+		{"no principals for another user", "bob", signCertificate(t, authority, key), false},
+		{"unknown user", "carol", signCertificate(t, authority, key, "carol"), false},
+		{"untrusted authority", "alice", signCertificate(t, newTestSigner(t), key, "alice"), false},
+	} {
+		err := login(addr, tt.user, tt.auth)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: login error %v, want success %v", tt.name, err, tt.ok)
+		}
+	}
+}
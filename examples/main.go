@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	
-	"github.com/oarkflow/sftp/pkg/models"
+	ftpserver "github.com/oarkflow/sftp"
+	"github.com/oarkflow/sftp/pkg/log/oarklog"
+	"github.com/oarkflow/sftp/pkg/providers"
 )
 
 type config struct {
@@ -15,7 +18,6 @@ type config struct {
 }
 
 func main() {
-	var users map[string]models.User
 	var conf config
 	configFile, err := os.ReadFile("config.json")
 	if err != nil {
@@ -25,17 +27,18 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	usersFile, err := os.ReadFile("users.json")
-	if err != nil {
-		panic(err)
+	// users.json and groups.json are reloaded on change, so partners are added without a restart.
+	userProvider := providers.NewJsonFileProvider("sha256", "")
+	if _, err := os.Stat("groups.json"); err == nil {
+		err = userProvider.WatchGroups(context.Background(), "groups.json", providers.DefaultWatchInterval, oarklog.Default())
+		if err != nil {
+			panic(err)
+		}
 	}
-	err = json.Unmarshal(usersFile, &users)
+	err = userProvider.Watch(context.Background(), "users.json", providers.DefaultWatchInterval, oarklog.Default())
 	if err != nil {
 		panic(err)
 	}
-	server := ftpserver.NewWithNotify()
-	for _, user := range users {
-		server.AddUser(user)
-	}
+	server := ftpserver.NewWithNotify(ftpserver.WithUserProvider(userProvider))
 	panic(server.Initialize())
 }
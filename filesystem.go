@@ -3,15 +3,21 @@ package sftp
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"time"
 	
 	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
 	"golang.org/x/crypto/ssh"
 	
 	"github.com/oarkflow/sftp/pkg/fs"
 	"github.com/oarkflow/sftp/pkg/fs/afos"
-	"github.com/oarkflow/sftp/pkg/fs/s3"
+	"github.com/oarkflow/sftp/pkg/fs/mount"
+	// Registers the "memory", "s3" and "sftp" backends.
+	_ "github.com/oarkflow/sftp/pkg/fs/memory"
+	_ "github.com/oarkflow/sftp/pkg/fs/s3"
+	_ "github.com/oarkflow/sftp/pkg/fs/sftpfs"
 	"github.com/oarkflow/sftp/pkg/log"
 	"github.com/oarkflow/sftp/pkg/models"
 	"github.com/oarkflow/sftp/pkg/providers"
@@ -157,70 +163,90 @@ func (f *FS) Type() string {
 }
 
 func (c *Server) getUserFilesystem(sconn *ssh.ServerConn, path string) (fs.FS, error) {
+	ext := sconn.Permissions.Extensions
+	if ext["mounts"] == "" {
+		return c.rootFilesystem(sconn, path)
+	}
+	var mounted []*models.Filesystem
+	if err := json.Unmarshal([]byte(ext["mounts"]), &mounted); err != nil {
+		return nil, err
+	}
+	// Users with nothing but mounted filesystems get a root only listing the mount points.
+	var root fs.FS
+	if ext["filesystem"] != "" {
+		var err error
+		if root, err = c.rootFilesystem(sconn, path); err != nil {
+			return nil, err
+		}
+	}
+	points := make([]mount.Point, 0, len(mounted))
+	for _, userFS := range mounted {
+		fst, err := c.newFilesystem(*userFS)
+		if err != nil {
+			return nil, fmt.Errorf("filesystem mounted at %s: %w", userFS.Mount, err)
+		}
+		points = append(points, mount.Point{Path: userFS.Mount, FS: fst})
+	}
+	fst, err := mount.New(root, points...)
+	if err != nil {
+		return nil, err
+	}
+	fst.SetLogger(c.logger)
+	return fst, nil
+}
+
+// rootFilesystem returns the filesystem the user is served from, or the default one.
+func (c *Server) rootFilesystem(sconn *ssh.ServerConn, path string) (fs.FS, error) {
 	var userFS models.Filesystem
 	if useDefaultFS, exists := sconn.Permissions.Extensions["default_fs"]; exists && useDefaultFS == "true" {
-		fst := afos.New(path)
-		fst.SetLogger(c.logger)
-		fst.SetPermissions(providers.DefaultPermissions)
-		return fst, nil
+		return c.defaultFilesystem(sconn, path)
 	}
 	
 	err := json.Unmarshal([]byte(sconn.Permissions.Extensions["filesystem"]), &userFS)
 	if err != nil {
-		fst := afos.New(path)
-		fst.SetLogger(c.logger)
-		fst.SetPermissions(providers.DefaultPermissions)
-		return fst, nil
+		return c.defaultFilesystem(sconn, path)
+	}
+	return c.newFilesystem(userFS)
+}
+
+// newFilesystem builds the filesystem described by userFS with its registered backend.
+func (c *Server) newFilesystem(userFS models.Filesystem) (fs.FS, error) {
+	fst, err := fs.NewBackend(userFS.Fs, userFS.Params)
+	if err != nil {
+		return nil, err
+	}
+	if home, ok := fst.(fs.Home); ok {
+		if dst, root := home.Home(); root != "" {
+			if err := c.prepareHome(dst, root); err != nil {
+				return nil, err
+			}
+		}
 	}
 	permissions := userFS.Permissions
 	if len(userFS.Permissions) == 0 {
 		permissions = providers.DefaultPermissions
 	}
-	switch userFS.Fs {
-	case "s3":
-		var endpoint, region, bucket, accessKey, secret string
-		if val, exists := userFS.Params["endpoint"]; exists {
-			endpoint = val.(string)
-		}
-		if val, exists := userFS.Params["region"]; exists {
-			region = val.(string)
-		} else {
-			region = "us-east-1"
-		}
-		if val, exists := userFS.Params["bucket"]; exists {
-			bucket = val.(string)
-		}
-		if val, exists := userFS.Params["access_key"]; exists {
-			accessKey = val.(string)
-		}
-		if val, exists := userFS.Params["secret"]; exists {
-			secret = val.(string)
-		}
-		opt := s3.Option{
-			Endpoint:  endpoint,
-			Region:    region,
-			Bucket:    bucket,
-			AccessKey: accessKey,
-			Secret:    secret,
-		}
-		fst, err := s3.New(opt)
+	fst.SetLogger(c.logger)
+	fst.SetPermissions(permissions)
+	return fst, nil
+}
+
+// defaultFilesystem serves users without a filesystem from the server base path, or from
+// their own home when a home directory template is configured.
+func (c *Server) defaultFilesystem(sconn *ssh.ServerConn, path string) (fs.FS, error) {
+	if c.homeDirectory != "" {
+		home, err := c.defaultHome(sconn)
 		if err != nil {
 			return nil, err
 		}
-		fst.SetLogger(c.logger)
-		fst.SetPermissions(permissions)
-		return fst, nil
-	case "os":
-		basePath := ""
-		if val, exists := userFS.Params["base_path"]; exists {
-			basePath = val.(string)
-		}
-		fst := afos.New(basePath)
-		fst.SetLogger(c.logger)
-		fst.SetPermissions(permissions)
-		return fst, nil
+		path = home
 	}
 	fst := afos.New(path)
+	if c.homeDirectory != "" {
+		if err := c.prepareHome(afero.NewOsFs(), fst.(*afos.Afos).Root()); err != nil {
+			return nil, err
+		}
+	}
 	fst.SetLogger(c.logger)
 	fst.SetPermissions(providers.DefaultPermissions)
 	return fst, nil
@@ -0,0 +1,127 @@
+package sftp
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// homeData returns what the filesystem templates of an authenticated connection are
+// executed with.
+func homeData(sconn *ssh.ServerConn) models.HomeData {
+	ext := sconn.Permissions.Extensions
+	id, _ := strconv.ParseInt(ext["user_id"], 10, 64)
+	return models.HomeData{ID: id, Username: ext["user"]}
+}
+
+// defaultHome returns the expanded home directory template for users without a filesystem.
+func (c *Server) defaultHome(sconn *ssh.ServerConn) (string, error) {
+	return models.ExpandPath("home_directory", c.homeDirectory, homeData(sconn))
+}
+
+// prepareHome creates the home directory root in dst when it is missing and fills it with
+// a copy of the skeleton directory. Existing homes are left untouched.
+func (c *Server) prepareHome(dst afero.Fs, root string) error {
+	c.homeMu.Lock()
+	defer c.homeMu.Unlock()
+	if _, err := dst.Stat(root); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	var err error
+	if c.skeletonDir == "" {
+		err = dst.MkdirAll(root, 0755)
+	} else {
+		err = installSkeleton(dst, root, c.skeletonDir)
+	}
+	if err != nil {
+		return err
+	}
+	c.logger.Info("Home directory created", "home", root, "skeleton", c.skeletonDir)
+	return nil
+}
+
+// installSkeleton copies skeleton to root without leaving a partial home behind, which
+// the next login would take for a complete one. On the local disk the copy is made in a
+// temporary sibling folder renamed into place; other backends cannot rename folders, so
+// the copy is made in place and removed again on failure.
+func installSkeleton(dst afero.Fs, root, skeleton string) error {
+	if _, ok := dst.(*afero.OsFs); !ok {
+		if err := dst.MkdirAll(root, 0755); err != nil {
+			return err
+		}
+		if err := copySkeleton(dst, root, skeleton); err != nil {
+			dst.RemoveAll(root)
+			return err
+		}
+		return nil
+	}
+	parent := filepath.Dir(filepath.Clean(root))
+	if err := dst.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	tmp, err := afero.TempDir(dst, parent, "."+filepath.Base(root)+"-")
+	if err != nil {
+		return err
+	}
+	err = dst.Chmod(tmp, 0755)
+	if err == nil {
+		err = copySkeleton(dst, tmp, skeleton)
+	}
+	if err == nil {
+		err = dst.Rename(tmp, root)
+	}
+	if err != nil {
+		dst.RemoveAll(tmp)
+	}
+	return err
+}
+
+// copySkeleton copies the directories and regular files of skeleton below root.
+func copySkeleton(dst afero.Fs, root, skeleton string) error {
+	return filepath.WalkDir(skeleton, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(skeleton, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(root, rel)
+		switch {
+		case d.IsDir():
+			return dst.MkdirAll(target, 0755)
+		case d.Type().IsRegular():
+			return copyFile(dst, target, p)
+		}
+		// Symlinks and special files could point outside the home directory.
+		return nil
+	})
+}
+
+func copyFile(dst afero.Fs, target, source string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := dst.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
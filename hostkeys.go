@@ -0,0 +1,302 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+	// hostKeyAlgorithmTTL is how long the algorithm negotiated for a host key is remembered
+	// for a connection that did not finish its handshake.
+	hostKeyAlgorithmTTL = 10 * time.Minute
+)
+
+// hostKeyFiles returns the configured host key files. By default an RSA, an ECDSA and an
+// Ed25519 key are loaded side by side.
+func (c *Server) hostKeyFiles() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.hostKeys) > 0 {
+		return append([]string(nil), c.hostKeys...)
+	}
+	return []string{c.privateKey, "id_ecdsa", "id_ed25519"}
+}
+
+// loadHostKeys reads the given host key files, generating the ones that do not exist yet.
+func (c *Server) loadHostKeys(files []string) ([]ssh.Signer, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no host key configured")
+	}
+	signers := make([]ssh.Signer, 0, len(files))
+	for _, file := range files {
+		if _, err := os.Stat(c.getSSHPath(file)); os.IsNotExist(err) {
+			if err := c.generateHostKey(file); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		privateBytes, err := os.ReadFile(c.getSSHPath(file))
+		if err != nil {
+			return nil, err
+		}
+		private, err := ssh.ParsePrivateKey(privateBytes)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, private)
+	}
+	return signers, nil
+}
+
+// Generates a host key that will be used by the SFTP server. The key type is derived from the
+// file name: names containing "ed25519" or "ecdsa" get a key of that type, anything else RSA.
+func (c *Server) generateHostKey(file string) error {
+	var pkey *pem.Block
+	switch name := filepath.Base(file); {
+	case strings.Contains(name, "ed25519"):
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		if pkey, err = ssh.MarshalPrivateKey(key, ""); err != nil {
+			return err
+		}
+	case strings.Contains(name, "ecdsa"):
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		if pkey, err = ssh.MarshalPrivateKey(key, ""); err != nil {
+			return err
+		}
+	default:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		pkey = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.getSSHPath(file)), 0755); err != nil {
+		return err
+	}
+
+	o, err := os.OpenFile(c.getSSHPath(file), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+	return pem.Encode(o, pkey)
+}
+
+// SetHostKeys replaces the host keys presented to new connections, generating missing key
+// files. Live sessions are kept open and told about the new keys through the
+// hostkeys-00@openssh.com global request so clients can update their known hosts. To rotate
+// a key, first add the new key next to the old one, then remove the old one once clients
+// had a chance to learn the new key.
+func (c *Server) SetHostKeys(files ...string) error {
+	signers, err := c.loadHostKeys(files)
+	if err != nil {
+		return err
+	}
+	config, err := c.newSSHConfig(signers)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.hostKeys = files
+	c.sshConfig = config
+	c.hostSigners = signers
+	conns := make([]*ssh.ServerConn, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		if s.sconn != nil {
+			conns = append(conns, s.sconn)
+		}
+	}
+	c.mu.Unlock()
+	c.logger.Info("Host keys updated", "host_keys", strings.Join(files, ","))
+	for _, sconn := range conns {
+		c.announceHostKeys(sconn)
+	}
+	return nil
+}
+
+// ReloadHostKeys reads the configured host key files again, e.g. after they were replaced on disk.
+func (c *Server) ReloadHostKeys() error {
+	return c.SetHostKeys(c.hostKeyFiles()...)
+}
+
+func (c *Server) currentHostSigners() []ssh.Signer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.hostSigners
+}
+
+// announceHostKeys sends all current host keys to the client.
+func (c *Server) announceHostKeys(sconn *ssh.ServerConn) {
+	var payload []byte
+	for _, signer := range c.currentHostSigners() {
+		payload = appendString(payload, signer.PublicKey().Marshal())
+	}
+	if _, _, err := sconn.SendRequest(hostKeysRequest, false, payload); err != nil {
+		c.logger.Warn("failed to announce host keys", "remote_addr", sconn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// handleGlobalRequests answers the connection level requests of a client. Clients that
+// received new host keys prove that the server owns them with hostkeys-prove-00@openssh.com,
+// everything else is rejected. algorithm is the signature algorithm negotiated for the host
+// key of the connection, if known.
+func (c *Server) handleGlobalRequests(sconn *ssh.ServerConn, reqs <-chan *ssh.Request, algorithm string) {
+	for req := range reqs {
+		if req.Type != hostKeysProveRequest {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+		payload, err := c.proveHostKeys(sconn.SessionID(), req.Payload, algorithm)
+		if err != nil {
+			c.logger.Warn("failed to prove host keys", "remote_addr", sconn.RemoteAddr().String(), "err", err)
+		}
+		req.Reply(err == nil, payload)
+	}
+}
+
+// proveHostKeys signs every requested host key blob together with the session identifier.
+func (c *Server) proveHostKeys(sessionID, request []byte, algorithm string) ([]byte, error) {
+	signers := c.currentHostSigners()
+	var response []byte
+	for len(request) > 0 {
+		blob, rest, ok := parseString(request)
+		if !ok {
+			return nil, errors.New("malformed host key blob")
+		}
+		request = rest
+		var signer ssh.Signer
+		for _, candidate := range signers {
+			if bytes.Equal(candidate.PublicKey().Marshal(), blob) {
+				signer = candidate
+				break
+			}
+		}
+		if signer == nil {
+			return nil, errors.New("requested host key is not in use")
+		}
+		var data []byte
+		data = appendString(data, []byte(hostKeysProveRequest))
+		data = appendString(data, sessionID)
+		data = appendString(data, blob)
+		sig, err := signHostKeyProof(signer, data, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		response = appendString(response, ssh.Marshal(sig))
+	}
+	return response, nil
+}
+
+// signHostKeyProof signs RSA proofs with the algorithm negotiated for the host key of the
+// connection, as OpenSSH clients expect. When the connection did not use an RSA host key,
+// SHA-512 is used since legacy ssh-rsa signatures are refused by current clients.
+func signHostKeyProof(signer ssh.Signer, data []byte, algorithm string) (*ssh.Signature, error) {
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		switch algorithm {
+		case ssh.KeyAlgoRSA, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512:
+		default:
+			algorithm = ssh.KeyAlgoRSASHA512
+		}
+		return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+	}
+	return signer.Sign(rand.Reader, data)
+}
+
+// hostKeyAlgorithms remembers the signature algorithm used by the host key during the key
+// exchange of each connection. The exchange hash signed by the first key exchange is the
+// session identifier of the connection, which is how entries are looked up afterwards.
+type hostKeyAlgorithms struct {
+	mu      sync.Mutex
+	entries map[string]hostKeyAlgorithm
+}
+
+type hostKeyAlgorithm struct {
+	algorithm string
+	at        time.Time
+}
+
+func (a *hostKeyAlgorithms) record(hash []byte, algorithm string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	for key, entry := range a.entries {
+		if now.Sub(entry.at) > hostKeyAlgorithmTTL {
+			delete(a.entries, key)
+		}
+	}
+	if a.entries == nil {
+		a.entries = make(map[string]hostKeyAlgorithm)
+	}
+	a.entries[string(hash)] = hostKeyAlgorithm{algorithm: algorithm, at: now}
+}
+
+// take returns and forgets the algorithm recorded for a session, or "" when it is unknown.
+func (a *hostKeyAlgorithms) take(sessionID []byte) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry := a.entries[string(sessionID)]
+	delete(a.entries, string(sessionID))
+	return entry.algorithm
+}
+
+// recordingSigner reports the algorithm of every signature made during key exchanges.
+type recordingSigner struct {
+	ssh.AlgorithmSigner
+	algorithms *hostKeyAlgorithms
+}
+
+func (s recordingSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	sig, err := s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+	if err == nil {
+		s.algorithms.record(data, sig.Format)
+	}
+	return sig, err
+}
+
+func appendString(buf, s []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func parseString(in []byte) ([]byte, []byte, bool) {
+	if len(in) < 4 {
+		return nil, nil, false
+	}
+	length := binary.BigEndian.Uint32(in)
+	in = in[4:]
+	if uint32(len(in)) < length {
+		return nil, nil, false
+	}
+	return in[:length], in[length:], true
+}
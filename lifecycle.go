@@ -0,0 +1,91 @@
+package sftp
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/providers"
+)
+
+// passwordLogin finishes a login with a verified password. Users whose password expired must
+// set a new one through keyboard-interactive before the second factor, if any.
+func (c *Server) passwordLogin(conn ssh.ConnMetadata, resp *fs.AuthenticationResponse) (*ssh.Permissions, error) {
+	if err := c.allowMethod(conn, "password", resp.User); err != nil {
+		return nil, err
+	}
+	if !resp.User.PasswordExpired(time.Now()) {
+		return c.secondFactor(conn, "password", resp)
+	}
+	return nil, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				if err := c.changePassword(conn, resp, client); err != nil {
+					return nil, err
+				}
+				return c.secondFactor(conn, "password", resp)
+			},
+		},
+	}
+}
+
+// changePassword asks the client for a new password and stores it through the user provider.
+func (c *Server) changePassword(conn ssh.ConnMetadata, resp *fs.AuthenticationResponse, client ssh.KeyboardInteractiveChallenge) error {
+	changer, ok := c.userProvider.(providers.PasswordChanger)
+	if !ok {
+		c.logger.Warn("password expired but the user provider cannot change passwords", "user", conn.User())
+		return errs.PasswordExpiredError{Username: conn.User()}
+	}
+	answers, err := client("", "Your password has expired, please choose a new one.",
+		[]string{"New password: ", "Retype new password: "}, []bool{false, false})
+	if err != nil {
+		return err
+	}
+	if len(answers) != 2 || answers[0] != answers[1] {
+		return errors.New("passwords do not match")
+	}
+	if err := changer.SetPassword(resp.User.Username, answers[0]); err != nil {
+		c.logger.Error("failed to change expired password", "user", conn.User(), "err", err)
+		return err
+	}
+	resp.User.PasswordExpiresAt = nil
+	c.logger.Info("Password Changed",
+		"user", conn.User(),
+		"event", "PasswordChanged",
+		"remote_addr", conn.RemoteAddr().String(),
+	)
+	c.notifyEvent(Notification{
+		User:          conn.User(),
+		ClientVersion: string(conn.ClientVersion()),
+		RemoteAddr:    conn.RemoteAddr().String(),
+		Time:          time.Now().UTC(),
+		Event:         "PasswordChanged",
+	})
+	return nil
+}
+
+// warnExpiry notifies when the account of an authenticated user expires within the
+// configured warning period.
+func (c *Server) warnExpiry(conn ssh.ConnMetadata, resp *fs.AuthenticationResponse, now time.Time) {
+	expiresAt := resp.User.ExpiresAt
+	if c.expiryWarning <= 0 || expiresAt == nil || expiresAt.Sub(now) > c.expiryWarning {
+		return
+	}
+	c.logger.Warn("Account Expiring",
+		"user", conn.User(),
+		"event", "AccountExpiring",
+		"remote_addr", conn.RemoteAddr().String(),
+		"expires_at", expiresAt.UTC().Format(time.RFC3339),
+	)
+	c.notifyEvent(Notification{
+		User:          conn.User(),
+		ClientVersion: string(conn.ClientVersion()),
+		RemoteAddr:    conn.RemoteAddr().String(),
+		Time:          now.UTC(),
+		Event:         "AccountExpiring",
+		Subject:       expiresAt.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,204 @@
+package sftp
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/ratelimit"
+	"github.com/oarkflow/sftp/pkg/utils"
+)
+
+// LimitError is returned when a connection or login is rejected because a limit is reached.
+type LimitError struct {
+	Limit string
+	Max   int
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d reached", e.Limit, e.Max)
+}
+
+// admitConn checks the global and per IP connection limits for a new connection. It must be
+// called with the server lock held, before the connection is tracked.
+func (c *Server) admitConn(conn net.Conn) error {
+	if c.maxConnections > 0 && len(c.sessions) >= c.maxConnections {
+		return LimitError{Limit: "connections", Max: c.maxConnections}
+	}
+	if c.maxConnectionsPerIP > 0 {
+		ip := utils.IP(conn.RemoteAddr())
+		count := 0
+		for _, s := range c.sessions {
+			if utils.IP(s.conn.RemoteAddr()).Equal(ip) {
+				count++
+			}
+		}
+		if count >= c.maxConnectionsPerIP {
+			return LimitError{Limit: "connections per IP", Max: c.maxConnectionsPerIP}
+		}
+	}
+	return nil
+}
+
+// reserveUserSession assigns the connection to the user unless the user already has the
+// maximum number of concurrent sessions. A user specific limit overrides the server one.
+func (c *Server) reserveUserSession(conn ssh.ConnMetadata, user string, userLimit int) error {
+	limit := c.maxSessionsPerUser
+	if userLimit > 0 {
+		limit = userLimit
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current := c.connSession(conn)
+	count := 0
+	for _, s := range c.sessions {
+		if s != current && s.user == user {
+			count++
+		}
+	}
+	if limit > 0 && count >= limit {
+		return LimitError{Limit: "sessions per user", Max: limit}
+	}
+	if current != nil {
+		current.user = user
+	}
+	return nil
+}
+
+// watchIdle closes the connection once no packet was received for the idle timeout.
+func (c *Server) watchIdle(s *session, sconn *ssh.ServerConn) {
+	if c.idleTimeout <= 0 {
+		return
+	}
+	s.touch()
+	closed := make(chan struct{})
+	go func() {
+		sconn.Wait()
+		close(closed)
+	}()
+	go func() {
+		timer := time.NewTimer(c.idleTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-timer.C:
+			}
+			idle := time.Since(s.lastSeen())
+			if idle < c.idleTimeout {
+				timer.Reset(c.idleTimeout - idle)
+				continue
+			}
+			c.logger.Info("Closing idle connection",
+				"user", sconn.User(),
+				"remote_addr", sconn.RemoteAddr().String(),
+				"idle", idle.String(),
+			)
+			sconn.Close()
+			return
+		}
+	}()
+}
+
+// activityChannel records the time of every packet read from an SFTP channel.
+type activityChannel struct {
+	ssh.Channel
+	session *session
+}
+
+func (a activityChannel) Read(data []byte) (int, error) {
+	n, err := a.Channel.Read(data)
+	if n > 0 {
+		a.session.touch()
+	}
+	return n, err
+}
+
+// rejectConn reports a connection refused before authentication.
+func (c *Server) rejectConn(conn net.Conn, err error) {
+	c.loginFailed("", conn.RemoteAddr().String(), "", err)
+}
+
+// loginFailed logs and notifies a rejected login.
+func (c *Server) loginFailed(user, remoteAddr, clientVersion string, err error) {
+	now := time.Now().UTC()
+	c.logger.Warn("Login Failed",
+		"user", user,
+		"event", "LoginFailed",
+		"remote_addr", remoteAddr,
+		"client_version", clientVersion,
+		"error", err,
+	)
+	c.notifyEvent(Notification{
+		User:          user,
+		ClientVersion: clientVersion,
+		RemoteAddr:    remoteAddr,
+		Time:          now,
+		Event:         "LoginFailed",
+		Error:         err,
+	})
+}
+
+func (c *Server) notifyEvent(notification Notification) {
+	if c.notify && c.notificationCallback != nil {
+		c.notificationCallback(notification)
+	}
+}
+
+// authFailed records a failed login attempt with the rate limiter.
+func (c *Server) authFailed(conn ssh.ConnMetadata) {
+	if c.rateLimiter != nil {
+		c.rateLimiter.Failure(utils.IP(conn.RemoteAddr()).String(), conn.User())
+	}
+}
+
+// keyFailed remembers that a public key or certificate was rejected. Clients offer all their
+// keys in turn, so the rejection only counts as a failed login once the connection ends
+// without being authenticated, see keyFailures.
+func (c *Server) keyFailed(conn ssh.ConnMetadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.connSession(conn); s != nil {
+		s.keyRejected = conn.User()
+	}
+}
+
+// keyFailures records the rejected keys of a connection that failed to authenticate.
+func (c *Server) keyFailures(s *session) {
+	c.mu.RLock()
+	user := s.keyRejected
+	c.mu.RUnlock()
+	if c.rateLimiter != nil && user != "" {
+		c.rateLimiter.Failure(utils.IP(s.conn.RemoteAddr()).String(), user)
+	}
+}
+
+// rateLimitEvent logs and notifies bans and unbans decided by the rate limiter.
+func (c *Server) rateLimitEvent(event ratelimit.Event) {
+	name := "Unban"
+	if event.Banned {
+		name = "Ban"
+	}
+	c.logger.Warn("Rate Limit "+name,
+		"event", name,
+		"kind", string(event.Kind),
+		"value", event.Value,
+		"until", event.Until.UTC().Format(time.RFC3339),
+	)
+	notification := Notification{
+		Time:    time.Now().UTC(),
+		Event:   name,
+		Subject: string(event.Kind),
+		Target:  event.Value,
+	}
+	switch event.Kind {
+	case ratelimit.IP:
+		notification.RemoteAddr = event.Value
+	case ratelimit.User:
+		notification.User = event.Value
+	}
+	c.notifyEvent(notification)
+}
@@ -1,7 +1,10 @@
 package sftp
 
 import (
+	"time"
+	
 	"github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/ratelimit"
 	interfaces2 "github.com/oarkflow/sftp/pkg/providers"
 )
 
@@ -41,20 +44,150 @@ func WithPrivateKey(val string) func(server *Server) {
 	}
 }
 
+// WithHostKeys sets the host key files, relative to the SSH path, presented to clients. Missing
+// files are generated with a key type derived from their name (ed25519, ecdsa, otherwise RSA).
+func WithHostKeys(files ...string) func(server *Server) {
+	return func(o *Server) {
+		o.hostKeys = files
+	}
+}
+
 func WithPublicKey(val string) func(server *Server) {
 	return func(o *Server) {
 		o.publicKey = val
 	}
 }
 
+// WithUserCAKeys trusts the certificate authority public keys listed in the given files, in
+// authorized_keys format, to sign user certificates. The login user must be one of the
+// certificate principals, certificates without principals are rejected, and must exist in
+// the user provider.
+func WithUserCAKeys(files ...string) func(server *Server) {
+	return func(o *Server) {
+		o.userCAKeys = append(o.userCAKeys, files...)
+	}
+}
+
+// WithRevocationList sets the file listing revoked user certificates. The file is reloaded
+// whenever it changes.
+func WithRevocationList(file string) func(server *Server) {
+	return func(o *Server) {
+		o.revocationList = file
+	}
+}
+
+// WithHostCertificate presents the given OpenSSH host certificate, relative to the SSH path,
+// alongside the host key. The certificate must be issued for the host key.
+func WithHostCertificate(val string) func(server *Server) {
+	return func(o *Server) {
+		o.hostCertificate = val
+	}
+}
+
 func WithCredentialValidator(val func(server *Server, r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error)) func(server *Server) {
 	return func(o *Server) {
 		o.credentialValidator = val
 	}
 }
 
+// WithPublicKeyValidator overrides how public key logins are checked. The offered key is
+// passed in the PublicKey field of the request in authorized_keys format.
+func WithPublicKeyValidator(val func(server *Server, r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error)) func(server *Server) {
+	return func(o *Server) {
+		o.publicKeyValidator = val
+	}
+}
+
 func WithNotificationCallback(callback NotificationHandler) func(srv *Server) {
 	return func(o *Server) {
 		o.notificationCallback = callback
 	}
 }
+
+// WithMaxConnections limits the number of concurrent connections to the server.
+func WithMaxConnections(val int) func(server *Server) {
+	return func(o *Server) {
+		o.maxConnections = val
+	}
+}
+
+// WithMaxConnectionsPerIP limits the number of concurrent connections from a single IP address.
+func WithMaxConnectionsPerIP(val int) func(server *Server) {
+	return func(o *Server) {
+		o.maxConnectionsPerIP = val
+	}
+}
+
+// WithMaxSessionsPerUser limits the number of concurrent sessions of a user. The MaxSessions
+// field of a user overrides it.
+func WithMaxSessionsPerUser(val int) func(server *Server) {
+	return func(o *Server) {
+		o.maxSessionsPerUser = val
+	}
+}
+
+// WithHandshakeTimeout closes connections that did not complete the SSH handshake, including
+// authentication, within the given duration.
+func WithHandshakeTimeout(val time.Duration) func(server *Server) {
+	return func(o *Server) {
+		o.handshakeTimeout = val
+	}
+}
+
+// WithIdleTimeout closes connections when no SFTP packet was received for the given duration.
+func WithIdleTimeout(val time.Duration) func(server *Server) {
+	return func(o *Server) {
+		o.idleTimeout = val
+	}
+}
+
+// WithRateLimiter bans source IPs and locks users after repeated failed logins. Ban and unban
+// events are logged and reported to the notification callback. Use ratelimit.New for the
+// default sliding window limiter.
+func WithRateLimiter(limiter ratelimit.Limiter) func(server *Server) {
+	return func(o *Server) {
+		o.rateLimiter = limiter
+		if limiter != nil {
+			limiter.Notify(o.rateLimitEvent)
+		}
+	}
+}
+
+// WithAllowedIPs restricts logins of every user to the given CIDR blocks or addresses.
+func WithAllowedIPs(cidrs ...string) func(server *Server) {
+	return func(o *Server) {
+		o.allowedIPs = append(o.allowedIPs, cidrs...)
+	}
+}
+
+// WithDeniedIPs rejects logins of every user from the given CIDR blocks or addresses.
+func WithDeniedIPs(cidrs ...string) func(server *Server) {
+	return func(o *Server) {
+		o.deniedIPs = append(o.deniedIPs, cidrs...)
+	}
+}
+
+// WithExpiryWarning logs a warning and sends an AccountExpiring notification when a user whose
+// account expires within the given duration logs in.
+func WithExpiryWarning(val time.Duration) func(server *Server) {
+	return func(o *Server) {
+		o.expiryWarning = val
+	}
+}
+
+// WithHomeDirectory gives users without a filesystem their own base path instead of the
+// server one. The path is a text/template executed with a models.HomeData, e.g.
+// "/srv/sftp/{{.Username}}" or "/srv/sftp/{{.ID}}".
+func WithHomeDirectory(val string) func(server *Server) {
+	return func(o *Server) {
+		o.homeDirectory = val
+	}
+}
+
+// WithSkeletonDir fills home directories with a copy of the given directory when they are
+// created on the first login.
+func WithSkeletonDir(val string) func(server *Server) {
+	return func(o *Server) {
+		o.skeletonDir = val
+	}
+}
@@ -1,5 +1,10 @@
 package errs
 
+import (
+	"errors"
+	"time"
+)
+
 // InvalidCredentialsError ... An error emitted when credentials are invalid.
 type InvalidCredentialsError struct {
 }
@@ -15,6 +20,104 @@ func IsInvalidCredentialsError(err error) bool {
 	return ok
 }
 
+// UserNotFoundError ... An error emitted when a user does not exist.
+type UserNotFoundError struct {
+	Username string
+}
+
+func (e UserNotFoundError) Error() string {
+	return "user " + e.Username + " not found"
+}
+
+// IsUserNotFoundError ... Checks if an error is or wraps a UserNotFoundError.
+func IsUserNotFoundError(err error) bool {
+	return errors.As(err, &UserNotFoundError{})
+}
+
+// UserExistsError ... An error emitted when creating a user whose username is taken.
+type UserExistsError struct {
+	Username string
+}
+
+func (e UserExistsError) Error() string {
+	return "user " + e.Username + " already exists"
+}
+
+// GroupNotFoundError ... An error emitted when a group does not exist.
+type GroupNotFoundError struct {
+	Name string
+}
+
+func (e GroupNotFoundError) Error() string {
+	return "group " + e.Name + " not found"
+}
+
+// IsGroupNotFoundError ... Checks if an error is or wraps a GroupNotFoundError.
+func IsGroupNotFoundError(err error) bool {
+	return errors.As(err, &GroupNotFoundError{})
+}
+
+// IPNotAllowedError ... An error emitted when a login comes from an address that is not allowed.
+type IPNotAllowedError struct {
+	IP string
+}
+
+func (e IPNotAllowedError) Error() string {
+	return "logins from " + e.IP + " are not allowed"
+}
+
+// AccountDisabledError ... An error emitted when a disabled user tries to log in.
+type AccountDisabledError struct {
+	Username string
+}
+
+func (e AccountDisabledError) Error() string {
+	return "account " + e.Username + " is disabled"
+}
+
+// AccountExpiredError ... An error emitted when an expired user tries to log in.
+type AccountExpiredError struct {
+	Username  string
+	ExpiredAt time.Time
+}
+
+func (e AccountExpiredError) Error() string {
+	return "account " + e.Username + " expired at " + e.ExpiredAt.Format(time.RFC3339)
+}
+
+// PasswordExpiredError ... An error emitted when a password expired and cannot be changed.
+type PasswordExpiredError struct {
+	Username string
+}
+
+func (e PasswordExpiredError) Error() string {
+	return "password of " + e.Username + " expired"
+}
+
+// UnknownBackendError ... An error emitted when a filesystem names a backend that is not registered.
+type UnknownBackendError struct {
+	Name string
+}
+
+func (e UnknownBackendError) Error() string {
+	return "unknown filesystem backend " + e.Name
+}
+
+// BackendParamsError ... An error emitted when a param of a filesystem is missing or invalid.
+type BackendParamsError struct {
+	Backend string
+	Param   string
+	Err     error
+}
+
+func (e BackendParamsError) Error() string {
+	return "filesystem " + e.Backend + ": param " + e.Param + ": " + e.Err.Error()
+}
+
+func (e BackendParamsError) Unwrap() error {
+	return e.Err
+}
+
 type FxError uint32
 
 const (
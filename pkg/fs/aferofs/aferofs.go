@@ -0,0 +1,301 @@
+// Package aferofs exposes any afero.Fs, e.g. a MemMapFs, a BasePathFs or a ReadOnlyFs,
+// through the SFTP handlers of fs.FS.
+package aferofs
+
+import (
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+
+	fs2 "github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/log"
+)
+
+// Fs adapts an afero.Fs to fs.FS. Paths of requests are cleaned and rooted at "/" before
+// they reach the afero.Fs, so wrap it in an afero.BasePathFs to confine users to a folder.
+type Fs struct {
+	fs          afero.Fs
+	logger      log.Logger
+	id          string
+	permissions int64
+	readOnly    bool
+	ctx         map[string]string
+	sconn       *ssh.ServerConn
+}
+
+func New(fs afero.Fs, opts ...func(*Fs)) fs2.FS {
+	f := &Fs{fs: fs}
+	for _, o := range opts {
+		o(f)
+	}
+	return f
+}
+
+func WithPermissions(val []string) func(*Fs) {
+	return func(o *Fs) {
+		o.permissions = fs2.Serialize(val)
+	}
+}
+
+func WithReadOnly(val bool) func(*Fs) {
+	return func(o *Fs) {
+		o.readOnly = val
+	}
+}
+
+// Afero returns the wrapped afero.Fs.
+func (f *Fs) Afero() afero.Fs {
+	return f.fs
+}
+
+func (f *Fs) SetPermissions(p []string) {
+	f.permissions = fs2.Serialize(p)
+}
+
+func (f *Fs) Permissions() []string {
+	return fs2.Deserialize(f.permissions)
+}
+
+func (f *Fs) SetID(p string) {
+	f.id = p
+}
+
+func (f *Fs) SetContext(ctx map[string]string) {
+	f.ctx = ctx
+}
+
+func (f *Fs) Context() map[string]string {
+	return f.ctx
+}
+
+func (f *Fs) SetLogger(logger log.Logger) {
+	f.logger = logger
+}
+
+func (f *Fs) Logger() log.Logger {
+	return f.logger
+}
+
+func (f *Fs) SetConn(sconn *ssh.ServerConn) {
+	f.sconn = sconn
+}
+
+func (f *Fs) Conn() *ssh.ServerConn {
+	return f.sconn
+}
+
+func (f *Fs) Type() string {
+	return "afero"
+}
+
+func clean(p string) string {
+	return path.Clean("/" + p)
+}
+
+// fail translates an error of the afero.Fs to an SFTP status, logging unexpected ones.
+func (f *Fs) fail(msg string, p string, err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return sftp.ErrSshFxNoSuchFile
+	case os.IsPermission(err):
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if f.logger != nil {
+		f.logger.Error(msg, "source", p, "err", err)
+	}
+	return sftp.ErrSshFxFailure
+}
+
+// Fileread opens a file of the afero.Fs for reading.
+func (f *Fs) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	if !fs2.Can(f.permissions, fs2.ReadContent) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+	p := clean(request.Filepath)
+	file, err := f.fs.Open(p)
+	if err != nil {
+		return nil, f.fail("could not open file for reading", p, err)
+	}
+	return file, nil
+}
+
+// Filewrite opens a file of the afero.Fs for writing, creating it along with its parent
+// directories when it does not exist.
+func (f *Fs) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	if f.readOnly {
+		return nil, sftp.ErrSshFxOpUnsupported
+	}
+	p := clean(request.Filepath)
+	stat, err := f.fs.Stat(p)
+	switch {
+	case os.IsNotExist(err):
+		if !fs2.Can(f.permissions, fs2.Create) {
+			return nil, sftp.ErrSshFxPermissionDenied
+		}
+		if err := f.fs.MkdirAll(path.Dir(p), 0755); err != nil {
+			return nil, f.fail("error making path for file", p, err)
+		}
+	case err != nil:
+		return nil, f.fail("error performing file stat", p, err)
+	case stat.IsDir():
+		return nil, sftp.ErrSshFxOpUnsupported
+	case !fs2.Can(f.permissions, fs2.Update):
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+	file, err := f.fs.OpenFile(p, openFlags(request), 0644)
+	if err != nil {
+		return nil, f.fail("error opening file for writing", p, err)
+	}
+	return file, nil
+}
+
+// openFlags maps the SFTP open flags of request to os.OpenFile flags. Appending is left
+// out, files opened with O_APPEND refuse the WriteAt calls of the SFTP server.
+func openFlags(request *sftp.Request) int {
+	if request.Flags == 0 {
+		return os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	pflags := request.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return flags
+}
+
+// Filecmd handles the SFTP commands on files and directories of the afero.Fs.
+func (f *Fs) Filecmd(request *sftp.Request) error {
+	if f.readOnly {
+		return sftp.ErrSshFxOpUnsupported
+	}
+	p := clean(request.Filepath)
+	target := clean(request.Target)
+	switch request.Method {
+	case "Setstat":
+		if !fs2.Can(f.permissions, fs2.Update) {
+			return sftp.ErrSshFxPermissionDenied
+		}
+		return f.setstat(request, p)
+	case "Rename":
+		if !fs2.Can(f.permissions, fs2.Update) {
+			return sftp.ErrSshFxPermissionDenied
+		}
+		if err := f.fs.Rename(p, target); err != nil {
+			return f.fail("failed to rename file", p, err)
+		}
+	case "Rmdir":
+		if !fs2.Can(f.permissions, fs2.Delete) {
+			return sftp.ErrSshFxPermissionDenied
+		}
+		if p == "/" {
+			return sftp.ErrSshFxPermissionDenied
+		}
+		if err := f.fs.RemoveAll(p); err != nil {
+			return f.fail("failed to remove directory", p, err)
+		}
+	case "Mkdir":
+		if !fs2.Can(f.permissions, fs2.Create) {
+			return sftp.ErrSshFxPermissionDenied
+		}
+		if err := f.fs.MkdirAll(p, 0755); err != nil {
+			return f.fail("failed to create directory", p, err)
+		}
+	case "Symlink":
+		if !fs2.Can(f.permissions, fs2.Create) {
+			return sftp.ErrSshFxPermissionDenied
+		}
+		linker, ok := f.fs.(afero.Linker)
+		if !ok {
+			return sftp.ErrSshFxOpUnsupported
+		}
+		if err := linker.SymlinkIfPossible(p, target); err != nil {
+			return f.fail("failed to create symlink", p, err)
+		}
+	case "Remove":
+		if !fs2.Can(f.permissions, fs2.Delete) {
+			return sftp.ErrSshFxPermissionDenied
+		}
+		if err := f.fs.Remove(p); err != nil {
+			return f.fail("failed to remove a file", p, err)
+		}
+	default:
+		return sftp.ErrSshFxOpUnsupported
+	}
+	return sftp.ErrSshFxOk
+}
+
+// setstat applies the attributes sent by the client. Ownership changes are ignored.
+func (f *Fs) setstat(request *sftp.Request, p string) error {
+	flags := request.AttrFlags()
+	attrs := request.Attributes()
+	if flags.Permissions {
+		mode := attrs.FileMode().Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := f.fs.Chmod(p, mode); err != nil {
+			return f.fail("failed to perform setstat", p, err)
+		}
+	}
+	if flags.Size {
+		file, err := f.fs.OpenFile(p, os.O_WRONLY, 0)
+		if err != nil {
+			return f.fail("failed to perform setstat", p, err)
+		}
+		err = file.Truncate(int64(attrs.Size))
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return f.fail("failed to perform setstat", p, err)
+		}
+	}
+	if flags.Acmodtime {
+		atime := time.Unix(int64(attrs.Atime), 0)
+		mtime := time.Unix(int64(attrs.Mtime), 0)
+		if err := f.fs.Chtimes(p, atime, mtime); err != nil {
+			return f.fail("failed to perform setstat", p, err)
+		}
+	}
+	return sftp.ErrSshFxOk
+}
+
+// Filelist lists the contents of a directory or stats a file of the afero.Fs.
+func (f *Fs) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	if !fs2.Can(f.permissions, fs2.Read) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+	p := clean(request.Filepath)
+	switch request.Method {
+	case "List":
+		files, err := afero.ReadDir(f.fs, p)
+		if err != nil {
+			return nil, f.fail("error listing directory", p, err)
+		}
+		return fs2.ListerAt(files), nil
+	case "Stat":
+		s, err := f.fs.Stat(p)
+		if err != nil {
+			return nil, f.fail("error running STAT on file", p, err)
+		}
+		return fs2.ListerAt([]os.FileInfo{s}), nil
+	default:
+		// Links are not followed, like the os backend does, as they could point outside
+		// the folder the afero.Fs is confined to.
+		return nil, sftp.ErrSshFxOpUnsupported
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"sync"
 	
 	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
 	"golang.org/x/crypto/ssh"
 	
 	"github.com/oarkflow/sftp/pkg/errs"
@@ -36,6 +37,7 @@ type Afos struct {
 func defaultAfos(basePath string) *Afos {
 	dataPath := "data"
 	return &Afos{
+		basePath: basePath,
 		dataPath: dataPath,
 		pathValidator: func(fs fs2.FS, p string) (string, error) {
 			join := path.Join(basePath, dataPath, p)
@@ -59,6 +61,31 @@ func New(basePath string, opts ...func(*Afos)) fs2.FS {
 	return svr
 }
 
+// Option is the params of the "os" backend.
+type Option struct {
+	BasePath string `json:"base_path"`
+}
+
+func init() {
+	fs2.RegisterBackend("os", func(params map[string]any) (fs2.FS, error) {
+		var opt Option
+		if err := fs2.DecodeParams("os", params, &opt); err != nil {
+			return nil, err
+		}
+		return New(opt.BasePath), nil
+	})
+}
+
+// Root returns the directory exposed to the user.
+func (f *Afos) Root() string {
+	return filepath.Join(f.basePath, f.dataPath)
+}
+
+// Home returns the directory exposed to the user on the local disk.
+func (f *Afos) Home() (afero.Fs, string) {
+	return afero.NewOsFs(), f.Root()
+}
+
 func (f *Afos) SetPermissions(p []string) {
 	f.permissions = fs2.Serialize(p)
 }
@@ -0,0 +1,105 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+)
+
+// BackendFactory builds a filesystem from the params of a models.Filesystem. Factories
+// should report bad params with errs.BackendParamsError, see DecodeParams.
+type BackendFactory func(params map[string]any) (FS, error)
+
+// Home is implemented by filesystems whose root the server creates, and fills from the
+// skeleton directory, on the first login of a user. An empty root disables it.
+type Home interface {
+	Home() (dst afero.Fs, root string)
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a filesystem backend available under name, the "fs" of a
+// models.Filesystem. Backends usually register themselves from an init function, like
+// "os" and "s3" do. It panics when name is already registered or factory is nil.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if factory == nil {
+		panic("fs: RegisterBackend factory is nil")
+	}
+	if _, exists := backends[name]; exists {
+		panic("fs: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = factory
+}
+
+// Backends returns the sorted names of the registered backends.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend builds a filesystem with the backend registered under name.
+func NewBackend(name string, params map[string]any) (FS, error) {
+	backendsMu.RLock()
+	factory, exists := backends[name]
+	backendsMu.RUnlock()
+	if !exists {
+		return nil, errs.UnknownBackendError{Name: name}
+	}
+	return factory(params)
+}
+
+// DecodeParams decodes params into the struct pointed to by v, matching the keys with the
+// json tags of its fields. Unknown params and params of the wrong type are reported as
+// errs.BackendParamsError of backend.
+func DecodeParams(backend string, params map[string]any, v any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("filesystem %s: %w", backend, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &typeErr):
+		return errs.BackendParamsError{
+			Backend: backend,
+			Param:   typeErr.Field,
+			Err:     fmt.Errorf("expected %s, got %s", typeErr.Type, typeErr.Value),
+		}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields.
+		param := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return errs.BackendParamsError{Backend: backend, Param: param, Err: errors.New("unknown param")}
+	}
+	return fmt.Errorf("filesystem %s: %w", backend, err)
+}
+
+// RequireParam reports a missing required param of backend when value is empty.
+func RequireParam(backend, param, value string) error {
+	if value == "" {
+		return errs.BackendParamsError{Backend: backend, Param: param, Err: errors.New("required")}
+	}
+	return nil
+}
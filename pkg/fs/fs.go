@@ -16,6 +16,9 @@ type AuthenticationRequest struct {
 	IP            string `json:"ip"`
 	SessionID     []byte `json:"session_id"`
 	ClientVersion []byte `json:"client_version"`
+	// PublicKey is the offered key in authorized_keys format when the client
+	// authenticates with a public key instead of a password.
+	PublicKey string `json:"public_key,omitempty"`
 }
 
 // AuthenticationResponse ... An authentication response from the SFTP server.
@@ -0,0 +1,325 @@
+// Package memory keeps files fully in memory, for tests of the server that should not touch
+// the disk and for short-lived drop boxes handing uploads over to a callback.
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	fs2 "github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/fs/aferofs"
+)
+
+// Upload is a file handed to the upload callback of a volume once it is written.
+type Upload struct {
+	Volume string
+	Path   string
+	Data   []byte
+	// Context is the context of the session, e.g. its "user" and "remote_addr".
+	Context map[string]string
+}
+
+// Volume holds the files of one or more memory filesystems.
+type Volume struct {
+	name        string
+	fs          afero.Fs
+	mu          sync.Mutex
+	used        int64
+	sizes       map[string]int64
+	maxSize     int64
+	maxFileSize int64
+	onUpload    func(Upload)
+	discard     bool
+}
+
+func NewVolume(opts ...func(*Volume)) *Volume {
+	v := &Volume{fs: afero.NewMemMapFs(), sizes: make(map[string]int64)}
+	for _, o := range opts {
+		o(v)
+	}
+	return v
+}
+
+// WithMaxSize limits the total size of the files of the volume, in bytes.
+func WithMaxSize(val int64) func(*Volume) {
+	return func(o *Volume) {
+		o.maxSize = val
+	}
+}
+
+// WithMaxFileSize limits the size of every file of the volume, in bytes.
+func WithMaxFileSize(val int64) func(*Volume) {
+	return func(o *Volume) {
+		o.maxFileSize = val
+	}
+}
+
+// WithUploadCallback calls val with every file once its upload completes.
+func WithUploadCallback(val func(Upload)) func(*Volume) {
+	return func(o *Volume) {
+		o.onUpload = val
+	}
+}
+
+// WithDiscardUploads removes files once they are handed to the upload callback, turning the
+// volume into a drop box.
+func WithDiscardUploads(val bool) func(*Volume) {
+	return func(o *Volume) {
+		o.discard = val
+	}
+}
+
+// Afero returns the files of the volume, e.g. to seed or inspect them in tests. Files
+// written through it do not count towards the limits of the volume.
+func (v *Volume) Afero() afero.Fs {
+	return v.fs
+}
+
+// Size returns the total size of the files of the volume.
+func (v *Volume) Size() int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.used
+}
+
+// FS returns a filesystem serving the files of the volume.
+func (v *Volume) FS() fs2.FS {
+	return &Fs{FS: aferofs.New(v.fs), volume: v}
+}
+
+// reserve accounts for the file name growing to size bytes.
+func (v *Volume) reserve(name string, size int64) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	n := size - v.sizes[name]
+	if n <= 0 {
+		return nil
+	}
+	if v.maxFileSize > 0 && size > v.maxFileSize {
+		return errs.ErrSSHQuotaExceeded
+	}
+	if v.maxSize > 0 && v.used+n > v.maxSize {
+		return errs.ErrSSHQuotaExceeded
+	}
+	v.sizes[name] = size
+	v.used += n
+	return nil
+}
+
+// recount accounts again for the files at and below each of names once they were removed,
+// renamed or truncated. Other files keep their accounting, including the space reserved
+// by writes in progress.
+func (v *Volume) recount(names ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, name := range names {
+		dir := strings.TrimSuffix(name, "/") + "/"
+		for p, size := range v.sizes {
+			if p == name || strings.HasPrefix(p, dir) {
+				v.used -= size
+				delete(v.sizes, p)
+			}
+		}
+		_ = afero.Walk(v.fs, name, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				v.sizes[p] = info.Size()
+				v.used += info.Size()
+			}
+			return nil
+		})
+	}
+}
+
+var (
+	volumesMu sync.Mutex
+	volumes   = make(map[string]*Volume)
+)
+
+// Register names a volume so filesystems configured with its name in the "volume" param
+// share its files, limits and upload callback.
+func Register(name string, v *Volume) {
+	volumesMu.Lock()
+	defer volumesMu.Unlock()
+	v.name = name
+	volumes[name] = v
+}
+
+// Lookup returns the volume registered under name.
+func Lookup(name string) (*Volume, bool) {
+	volumesMu.Lock()
+	defer volumesMu.Unlock()
+	v, exists := volumes[name]
+	return v, exists
+}
+
+// Option is the params of the "memory" backend. Filesystems without a volume get their own,
+// dropped with the session. The limits apply to the volume created from the params; limits
+// differing from the ones of an existing volume are rejected.
+type Option struct {
+	Volume      string `json:"volume"`
+	MaxSize     int64  `json:"max_size"`
+	MaxFileSize int64  `json:"max_file_size"`
+}
+
+func init() {
+	fs2.RegisterBackend("memory", func(params map[string]any) (fs2.FS, error) {
+		var opt Option
+		if err := fs2.DecodeParams("memory", params, &opt); err != nil {
+			return nil, err
+		}
+		limits := []func(*Volume){WithMaxSize(opt.MaxSize), WithMaxFileSize(opt.MaxFileSize)}
+		if opt.Volume == "" {
+			return NewVolume(limits...).FS(), nil
+		}
+		volumesMu.Lock()
+		defer volumesMu.Unlock()
+		v, exists := volumes[opt.Volume]
+		if !exists {
+			v = NewVolume(limits...)
+			v.name = opt.Volume
+			volumes[opt.Volume] = v
+			return v.FS(), nil
+		}
+		if opt.MaxSize != 0 && opt.MaxSize != v.maxSize {
+			return nil, errs.BackendParamsError{
+				Backend: "memory",
+				Param:   "max_size",
+				Err:     fmt.Errorf("volume %s is limited to %d bytes", opt.Volume, v.maxSize),
+			}
+		}
+		if opt.MaxFileSize != 0 && opt.MaxFileSize != v.maxFileSize {
+			return nil, errs.BackendParamsError{
+				Backend: "memory",
+				Param:   "max_file_size",
+				Err:     fmt.Errorf("files of volume %s are limited to %d bytes", opt.Volume, v.maxFileSize),
+			}
+		}
+		return v.FS(), nil
+	})
+}
+
+// Fs serves the files of a volume, enforcing its limits.
+type Fs struct {
+	fs2.FS
+	volume *Volume
+}
+
+// Volume returns the volume the files are kept in.
+func (f *Fs) Volume() *Volume {
+	return f.volume
+}
+
+func (f *Fs) Type() string {
+	return "memory"
+}
+
+// Filewrite opens the file for writing. Writes beyond the limits of the volume fail with
+// a quota exceeded error.
+func (f *Fs) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	w, err := f.FS.Filewrite(request)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := w.(afero.File)
+	if !ok {
+		if c, ok := w.(io.Closer); ok {
+			c.Close()
+		}
+		return nil, sftp.ErrSshFxFailure
+	}
+	name := path.Clean("/" + request.Filepath)
+	// Opening with O_TRUNC may have released space.
+	f.volume.recount(name)
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, sftp.ErrSshFxFailure
+	}
+	return &writer{File: file, fs: f, name: name, size: stat.Size()}, nil
+}
+
+// Filecmd runs the command and accounts for the space it released. Truncating a file to
+// a larger size is subject to the limits of the volume like writes are.
+func (f *Fs) Filecmd(request *sftp.Request) error {
+	name := path.Clean("/" + request.Filepath)
+	if request.Method == "Setstat" && request.AttrFlags().Size {
+		if err := f.volume.reserve(name, int64(request.Attributes().Size)); err != nil {
+			return err
+		}
+	}
+	err := f.FS.Filecmd(request)
+	if request.Method == "Setstat" || err == nil || errors.Is(err, sftp.ErrSshFxOk) {
+		// A failed Setstat gives back what was reserved for it.
+		names := []string{name}
+		if request.Method == "Rename" {
+			names = append(names, path.Clean("/"+request.Target))
+		}
+		f.volume.recount(names...)
+	}
+	return err
+}
+
+// writer counts the bytes written to a file and hands it to the upload callback once closed.
+type writer struct {
+	afero.File
+	fs     *Fs
+	name   string
+	mu     sync.Mutex
+	size   int64
+	failed bool
+}
+
+func (w *writer) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if end := off + int64(len(p)); end > w.size {
+		if err := w.fs.volume.reserve(w.name, end); err != nil {
+			w.failed = true
+			return 0, err
+		}
+		w.size = end
+	}
+	return w.File.WriteAt(p, off)
+}
+
+// TransferError marks uploads interrupted by the client, they are not handed over.
+func (w *writer) TransferError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failed = true
+}
+
+func (w *writer) Close() error {
+	if err := w.File.Close(); err != nil {
+		return err
+	}
+	v := w.fs.volume
+	w.mu.Lock()
+	failed := w.failed
+	w.mu.Unlock()
+	if failed || v.onUpload == nil {
+		return nil
+	}
+	p := w.File.Name()
+	data, err := afero.ReadFile(v.fs, p)
+	if err != nil {
+		return err
+	}
+	v.onUpload(Upload{Volume: v.name, Path: p, Data: data, Context: w.fs.Context()})
+	if v.discard {
+		if err := v.fs.Remove(p); err != nil {
+			return err
+		}
+		v.recount(w.name)
+	}
+	return nil
+}
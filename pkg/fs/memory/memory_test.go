@@ -0,0 +1,164 @@
+package memory
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	fs2 "github.com/oarkflow/sftp/pkg/fs"
+)
+
+var allPermissions = []string{"read", "read-content", "create", "update", "delete"}
+
+func newTestFs(v *Volume) *Fs {
+	f := v.FS().(*Fs)
+	f.SetPermissions(allPermissions)
+	return f
+}
+
+// open starts an upload of name, truncating the file like a plain put does.
+func open(t *testing.T, f *Fs, name string) io.WriterAt {
+	t.Helper()
+	w, err := f.Filewrite(sftp.NewRequest("Put", name))
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	return w
+}
+
+func upload(t *testing.T, f *Fs, name string, data []byte) error {
+	t.Helper()
+	w := open(t, f, name)
+	_, err := w.WriteAt(data, 0)
+	if cerr := w.(io.Closer).Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func command(f *Fs, method, name, target string) error {
+	request := sftp.NewRequest(method, name)
+	request.Target = target
+	if err := f.Filecmd(request); !errors.Is(err, sftp.ErrSshFxOk) {
+		return err
+	}
+	return nil
+}
+
+func TestVolumeQuota(t *testing.T) {
+	v := NewVolume(WithMaxSize(10), WithMaxFileSize(6))
+	f := newTestFs(v)
+	if err := upload(t, f, "/a", make([]byte, 6)); err != nil {
+		t.Fatalf("upload within the limits: %v", err)
+	}
+	if err := upload(t, f, "/b", make([]byte, 7)); !errors.Is(err, errs.ErrSSHQuotaExceeded) {
+		t.Fatalf("file above the file limit: got %v, want a quota error", err)
+	}
+	if err := upload(t, f, "/b", make([]byte, 5)); !errors.Is(err, errs.ErrSSHQuotaExceeded) {
+		t.Fatalf("file above the volume limit: got %v, want a quota error", err)
+	}
+	if err := upload(t, f, "/b", make([]byte, 4)); err != nil {
+		t.Fatalf("upload filling the volume: %v", err)
+	}
+	if size := v.Size(); size != 10 {
+		t.Fatalf("size = %d, want 10", size)
+	}
+
+	// Overwriting a file releases its previous content.
+	if err := upload(t, f, "/a", make([]byte, 2)); err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+	if size := v.Size(); size != 6 {
+		t.Fatalf("size after an overwrite = %d, want 6", size)
+	}
+
+	// Space reserved by an upload in progress survives commands on other files.
+	w := open(t, f, "/c")
+	if _, err := w.WriteAt(make([]byte, 3), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := command(f, "Rename", "/a", "/d/a"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := command(f, "Remove", "/b", ""); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if size := v.Size(); size != 5 {
+		t.Fatalf("size after removing /b = %d, want 5", size)
+	}
+	if _, err := w.WriteAt(make([]byte, 6), 3); !errors.Is(err, errs.ErrSSHQuotaExceeded) {
+		t.Fatalf("write above the file limit: got %v, want a quota error", err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := command(f, "Rmdir", "/d", ""); err != nil {
+		t.Fatalf("rmdir: %v", err)
+	}
+	if size := v.Size(); size != 3 {
+		t.Fatalf("size after removing /d = %d, want 3", size)
+	}
+}
+
+func TestVolumeUploadCallback(t *testing.T) {
+	var uploads []Upload
+	v := NewVolume(WithUploadCallback(func(u Upload) { uploads = append(uploads, u) }), WithDiscardUploads(true))
+	Register("callback", v)
+	f := newTestFs(v)
+	f.SetContext(map[string]string{"user": "alice"})
+	if err := upload(t, f, "/in/report.csv", []byte("a,b\n")); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if len(uploads) != 1 {
+		t.Fatalf("%d uploads handed over, want 1", len(uploads))
+	}
+	u := uploads[0]
+	if u.Volume != "callback" || u.Path != "/in/report.csv" || string(u.Data) != "a,b\n" || u.Context["user"] != "alice" {
+		t.Fatalf("upload = %+v", u)
+	}
+	if exists, _ := afero.Exists(v.Afero(), "/in/report.csv"); exists || v.Size() != 0 {
+		t.Fatalf("discarded upload kept, size %d", v.Size())
+	}
+
+	// Interrupted uploads are not handed over.
+	w := open(t, f, "/in/partial.csv")
+	if _, err := w.WriteAt([]byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	w.(interface{ TransferError(error) }).TransferError(io.ErrUnexpectedEOF)
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 {
+		t.Fatalf("%d uploads handed over, the interrupted one must not be", len(uploads))
+	}
+}
+
+func TestBackendVolumeLimits(t *testing.T) {
+	params := map[string]any{"volume": "limits", "max_size": 100, "max_file_size": 10}
+	first, err := fs2.NewBackend("memory", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs2.NewBackend("memory", map[string]any{"volume": "limits"}); err != nil {
+		t.Fatalf("volume without limits: %v", err)
+	}
+	second, err := fs2.NewBackend("memory", params)
+	if err != nil {
+		t.Fatalf("volume with the same limits: %v", err)
+	}
+	if first.(*Fs).Volume() != second.(*Fs).Volume() {
+		t.Fatal("filesystems of a volume do not share its files")
+	}
+	for param, val := range map[string]any{"max_size": 200, "max_file_size": 20} {
+		var paramsErr errs.BackendParamsError
+		_, err := fs2.NewBackend("memory", map[string]any{"volume": "limits", param: val})
+		if !errors.As(err, &paramsErr) || paramsErr.Param != param {
+			t.Fatalf("conflicting %s: got %v, want a BackendParamsError", param, err)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+// Package mount composes several filesystems into one, each mounted at its own virtual
+// folder, e.g. "/archive" on S3 and "/inbox" on the local disk.
+package mount
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	fs2 "github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/log"
+)
+
+// Flags of the SSH_FXP_OPEN request used to write the target of a cross-mount rename.
+const (
+	fxfWrite = 0x00000002
+	fxfCreat = 0x00000008
+	fxfTrunc = 0x00000010
+)
+
+// Point is a filesystem mounted at an absolute virtual path.
+type Point struct {
+	Path string
+	FS   fs2.FS
+}
+
+// FS routes requests to the filesystem mounted at the longest matching path prefix, and to
+// the root filesystem for paths outside every mount point. Without a root filesystem, the
+// root is a read-only folder listing the mount points.
+type FS struct {
+	root        fs2.FS
+	points      []Point
+	logger      log.Logger
+	id          string
+	permissions []string
+	ctx         map[string]string
+	sconn       *ssh.ServerConn
+	mountedAt   time.Time
+}
+
+// New mounts points over root, which may be nil. Mount paths are cleaned and must be
+// unique and other than "/".
+func New(root fs2.FS, points ...Point) (fs2.FS, error) {
+	f := &FS{root: root, mountedAt: time.Now()}
+	seen := make(map[string]struct{}, len(points))
+	for _, point := range points {
+		if point.FS == nil {
+			return nil, errors.New("mount point " + point.Path + " without filesystem")
+		}
+		point.Path = path.Clean("/" + point.Path)
+		if point.Path == "/" {
+			return nil, errors.New("filesystems cannot be mounted at /")
+		}
+		if _, exists := seen[point.Path]; exists {
+			return nil, errors.New("duplicate mount point " + point.Path)
+		}
+		seen[point.Path] = struct{}{}
+		f.points = append(f.points, point)
+	}
+	// Longest paths first so nested mount points win over their parents.
+	sort.SliceStable(f.points, func(i, j int) bool {
+		return len(f.points[i].Path) > len(f.points[j].Path)
+	})
+	return f, nil
+}
+
+// Points returns the mount points, longest path first.
+func (f *FS) Points() []Point {
+	return f.points
+}
+
+// resolve returns the filesystem serving p and the path of p within it. The filesystem is
+// nil when p is outside every mount point and there is no root filesystem.
+func (f *FS) resolve(p string) (fs2.FS, string) {
+	p = path.Clean("/" + p)
+	for _, point := range f.points {
+		if p == point.Path {
+			return point.FS, "/"
+		}
+		if strings.HasPrefix(p, point.Path+"/") {
+			return point.FS, strings.TrimPrefix(p, point.Path)
+		}
+	}
+	return f.root, p
+}
+
+// isMountPoint reports whether p is a mount point.
+func (f *FS) isMountPoint(p string) bool {
+	p = path.Clean("/" + p)
+	for _, point := range f.points {
+		if p == point.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// children returns the names of the virtual folders directly below p leading to mount
+// points, sorted.
+func (f *FS) children(p string) []string {
+	p = path.Clean("/" + p)
+	prefix := p
+	if prefix != "/" {
+		prefix += "/"
+	}
+	var names []string
+	seen := make(map[string]struct{})
+	for _, point := range f.points {
+		if !strings.HasPrefix(point.Path, prefix) {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(point.Path, prefix), "/")
+		if _, exists := seen[name]; !exists {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// rewrite returns a copy of request addressing the filesystem paths instead of the virtual ones.
+func rewrite(request *sftp.Request, filepath, target string) *sftp.Request {
+	r := request.WithContext(request.Context())
+	r.Filepath = filepath
+	r.Target = target
+	return r
+}
+
+// Fileread reads the file from the filesystem it is mounted on.
+func (f *FS) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	fst, p := f.resolve(request.Filepath)
+	if fst == nil {
+		return nil, sftp.ErrSshFxNoSuchFile
+	}
+	return fst.Fileread(rewrite(request, p, ""))
+}
+
+// Filewrite writes the file to the filesystem it is mounted on. The virtual folders of a
+// root without filesystem are read-only.
+func (f *FS) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	fst, p := f.resolve(request.Filepath)
+	if fst == nil {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+	return fst.Filewrite(rewrite(request, p, ""))
+}
+
+// Filecmd runs the command on the filesystem the path is mounted on. Mount points cannot
+// be removed or renamed, and renames across filesystems are done as a copy followed by a
+// removal of the source.
+func (f *FS) Filecmd(request *sftp.Request) error {
+	fst, p := f.resolve(request.Filepath)
+	switch request.Method {
+	case "Rename", "Remove", "Rmdir":
+		if f.isMountPoint(request.Filepath) || len(f.children(request.Filepath)) > 0 {
+			return sftp.ErrSshFxPermissionDenied
+		}
+	}
+	if fst == nil {
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if request.Target == "" {
+		return fst.Filecmd(rewrite(request, p, ""))
+	}
+	targetFS, target := f.resolve(request.Target)
+	if targetFS == nil || f.isMountPoint(request.Target) {
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if targetFS == fst {
+		return fst.Filecmd(rewrite(request, p, target))
+	}
+	if request.Method != "Rename" {
+		return sftp.ErrSshFxOpUnsupported
+	}
+	if err := f.move(request, fst, p, targetFS, target); err != nil {
+		f.logger.Error("failed to move file across mount points",
+			"source", request.Filepath,
+			"target", request.Target,
+			"err", err,
+		)
+		return err
+	}
+	return sftp.ErrSshFxOk
+}
+
+// move copies p of src to target of dst, then removes p.
+func (f *FS) move(request *sftp.Request, src fs2.FS, p string, dst fs2.FS, target string) error {
+	info, err := stat(src, rewrite(request, p, ""))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := copyFile(request, src, p, dst, target); err != nil {
+			return err
+		}
+		return ignoreOk(src.Filecmd(method(request, "Remove", p)))
+	}
+	if err := ignoreOk(dst.Filecmd(method(request, "Mkdir", target))); err != nil {
+		return err
+	}
+	lister, err := src.Filelist(method(request, "List", p))
+	if err != nil {
+		return err
+	}
+	entries, err := readAll(lister)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := f.move(request, src, path.Join(p, entry.Name()), dst, path.Join(target, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return ignoreOk(src.Filecmd(method(request, "Rmdir", p)))
+}
+
+// copyFile streams p of src to target of dst.
+func copyFile(request *sftp.Request, src fs2.FS, p string, dst fs2.FS, target string) error {
+	reader, err := src.Fileread(method(request, "Get", p))
+	if err != nil {
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	put := method(request, "Put", target)
+	put.Flags = fxfWrite | fxfCreat | fxfTrunc
+	writer, err := dst.Filewrite(put)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.NewOffsetWriter(writer, 0), io.NewSectionReader(reader, 0, 1<<63-1))
+	if closer, ok := writer.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func method(request *sftp.Request, name, p string) *sftp.Request {
+	r := rewrite(request, p, "")
+	r.Method = name
+	return r
+}
+
+func stat(fst fs2.FS, request *sftp.Request) (os.FileInfo, error) {
+	request.Method = "Stat"
+	lister, err := fst.Filelist(request)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 1)
+	if n, err := lister.ListAt(infos, 0); n == 0 {
+		if err == nil || err == io.EOF {
+			err = sftp.ErrSshFxNoSuchFile
+		}
+		return nil, err
+	}
+	return infos[0], nil
+}
+
+func readAll(lister sftp.ListerAt) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	buf := make([]os.FileInfo, 128)
+	for {
+		n, err := lister.ListAt(buf, int64(len(entries)))
+		entries = append(entries, buf[:n]...)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return entries, nil
+		}
+	}
+}
+
+// ignoreOk drops the status OK some filesystems report successful commands with.
+func ignoreOk(err error) error {
+	if errors.Is(err, sftp.ErrSshFxOk) {
+		return nil
+	}
+	return err
+}
+
+// Filelist lists or stats the path on the filesystem it is mounted on. Mount points and
+// the virtual folders leading to them are listed along with the entries of the filesystem.
+func (f *FS) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	fst, p := f.resolve(request.Filepath)
+	clean := path.Clean("/" + request.Filepath)
+	children := f.children(clean)
+	switch request.Method {
+	case "Stat":
+		if f.isMountPoint(clean) || len(children) > 0 || (fst == nil && clean == "/") {
+			return fs2.ListerAt([]os.FileInfo{f.dirInfo(path.Base(clean))}), nil
+		}
+	case "List":
+		var entries []os.FileInfo
+		if fst == f.root && fst != nil && len(children) > 0 && clean != "/" {
+			// Virtual folders leading to mount points need not exist in the root filesystem.
+			if _, err := stat(fst, rewrite(request, p, "")); err != nil {
+				fst = nil
+			}
+		}
+		if fst != nil {
+			lister, err := fst.Filelist(rewrite(request, p, ""))
+			if err != nil {
+				return nil, err
+			}
+			if entries, err = readAll(lister); err != nil {
+				return nil, err
+			}
+		} else if len(children) == 0 && clean != "/" {
+			return nil, sftp.ErrSshFxNoSuchFile
+		}
+		return fs2.ListerAt(f.withChildren(entries, children)), nil
+	}
+	if fst == nil {
+		return nil, sftp.ErrSshFxNoSuchFile
+	}
+	return fst.Filelist(rewrite(request, p, ""))
+}
+
+// withChildren adds the virtual folders to entries, replacing entries of the same name.
+func (f *FS) withChildren(entries []os.FileInfo, children []string) []os.FileInfo {
+	if len(children) == 0 {
+		return entries
+	}
+	shadowed := make(map[string]struct{}, len(children))
+	for _, name := range children {
+		shadowed[name] = struct{}{}
+	}
+	result := make([]os.FileInfo, 0, len(entries)+len(children))
+	for _, entry := range entries {
+		if _, exists := shadowed[entry.Name()]; !exists {
+			result = append(result, entry)
+		}
+	}
+	for _, name := range children {
+		result = append(result, f.dirInfo(name))
+	}
+	return result
+}
+
+func (f *FS) dirInfo(name string) os.FileInfo {
+	return dirInfo{name: name, modTime: f.mountedAt}
+}
+
+// dirInfo describes a mount point or a virtual folder leading to one.
+type dirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (d dirInfo) Name() string       { return d.name }
+func (d dirInfo) Size() int64        { return 0 }
+func (d dirInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d dirInfo) ModTime() time.Time { return d.modTime }
+func (d dirInfo) IsDir() bool        { return true }
+func (d dirInfo) Sys() any           { return nil }
+
+// each calls fn with the root filesystem, when set, and every mounted filesystem.
+func (f *FS) each(fn func(fs2.FS)) {
+	if f.root != nil {
+		fn(f.root)
+	}
+	for _, point := range f.points {
+		fn(point.FS)
+	}
+}
+
+func (f *FS) SetLogger(logger log.Logger) {
+	f.logger = logger
+	f.each(func(fst fs2.FS) { fst.SetLogger(logger) })
+}
+
+func (f *FS) Logger() log.Logger {
+	return f.logger
+}
+
+// SetPermissions only records the permissions; every mounted filesystem keeps its own.
+func (f *FS) SetPermissions(p []string) {
+	f.permissions = p
+}
+
+func (f *FS) Permissions() []string {
+	return f.permissions
+}
+
+func (f *FS) SetContext(ctx map[string]string) {
+	f.ctx = ctx
+	f.each(func(fst fs2.FS) { fst.SetContext(ctx) })
+}
+
+func (f *FS) Context() map[string]string {
+	return f.ctx
+}
+
+func (f *FS) SetConn(sconn *ssh.ServerConn) {
+	f.sconn = sconn
+	f.each(func(fst fs2.FS) { fst.SetConn(sconn) })
+}
+
+func (f *FS) Conn() *ssh.ServerConn {
+	return f.sconn
+}
+
+func (f *FS) SetID(p string) {
+	f.id = p
+	f.each(func(fst fs2.FS) { fst.SetID(p) })
+}
+
+func (f *FS) Type() string {
+	return "mount"
+}
@@ -0,0 +1,243 @@
+package mount
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+
+	fs2 "github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/fs/memory"
+)
+
+var allPermissions = []string{"read", "read-content", "create", "update", "delete"}
+
+func newVolume() (*memory.Volume, fs2.FS) {
+	v := memory.NewVolume()
+	f := v.FS()
+	f.SetPermissions(allPermissions)
+	return v, f
+}
+
+func newTestMount(t *testing.T, root fs2.FS, points ...Point) fs2.FS {
+	t.Helper()
+	f, err := New(root, points...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func write(t *testing.T, f fs2.FS, name, data string) {
+	t.Helper()
+	w, err := f.Filewrite(sftp.NewRequest("Put", name))
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	if _, err := w.WriteAt([]byte(data), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(t *testing.T, f fs2.FS, name string) string {
+	t.Helper()
+	r, err := f.Fileread(sftp.NewRequest("Get", name))
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	defer r.(io.Closer).Close()
+	data, err := io.ReadAll(io.NewSectionReader(r, 0, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func list(t *testing.T, f fs2.FS, name string) string {
+	t.Helper()
+	lister, err := f.Filelist(sftp.NewRequest("List", name))
+	if err != nil {
+		t.Fatalf("list %s: %v", name, err)
+	}
+	var names []string
+	for _, info := range lister.(fs2.ListerAt) {
+		if info.IsDir() {
+			names = append(names, info.Name()+"/")
+		} else {
+			names = append(names, info.Name())
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func command(f fs2.FS, method, name, target string) error {
+	request := sftp.NewRequest(method, name)
+	request.Target = target
+	if err := f.Filecmd(request); !errors.Is(err, sftp.ErrSshFxOk) {
+		return err
+	}
+	return nil
+}
+
+// exists reports whether name is stored in the volume itself.
+func exists(t *testing.T, v *memory.Volume, name string) bool {
+	t.Helper()
+	ok, err := afero.Exists(v.Afero(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestRouting(t *testing.T) {
+	root, rootFS := newVolume()
+	data, dataFS := newVolume()
+	nested, nestedFS := newVolume()
+	f := newTestMount(t, rootFS, Point{Path: "/data", FS: dataFS}, Point{Path: "data/nested/", FS: nestedFS})
+
+	for _, tt := range []struct {
+		name   string
+		volume *memory.Volume
+		stored string
+	}{
+		{"/top.txt", root, "/top.txt"},
+		{"/data/a.txt", data, "/a.txt"},
+		{"/data/dir/b.txt", data, "/dir/b.txt"},
+		{"/data/nested/c.txt", nested, "/c.txt"},
+		// Prefixes only match whole path elements.
+		{"/database.txt", root, "/database.txt"},
+		{"/data/nestedfile.txt", data, "/nestedfile.txt"},
+		{"/data/../top2.txt", root, "/top2.txt"},
+	} {
+		write(t, f, tt.name, tt.name)
+		if !exists(t, tt.volume, tt.stored) {
+			t.Errorf("%s not stored as %s of the expected filesystem", tt.name, tt.stored)
+		}
+		if got := read(t, f, tt.name); got != tt.name {
+			t.Errorf("read %s = %q", tt.name, got)
+		}
+	}
+	if exists(t, root, "/data/a.txt") || exists(t, data, "/nested/c.txt") {
+		t.Fatal("file written to the filesystem below a mount point")
+	}
+	if got := list(t, f, "/data"); got != "a.txt dir/ nestedfile.txt nested/" {
+		t.Fatalf("list /data = %q", got)
+	}
+	// Root entries named like a mount point are hidden by it.
+	write(t, rootFS, "/data", "shadowed")
+	if got := list(t, f, "/"); got != "database.txt top.txt top2.txt data/" {
+		t.Fatalf("list / = %q", got)
+	}
+	for _, name := range []string{"/data", "/data/nested"} {
+		if err := command(f, "Remove", name, ""); !errors.Is(err, sftp.ErrSshFxPermissionDenied) {
+			t.Errorf("remove mount point %s: got %v, want permission denied", name, err)
+		}
+		if err := command(f, "Rename", name, "/moved"); !errors.Is(err, sftp.ErrSshFxPermissionDenied) {
+			t.Errorf("rename mount point %s: got %v, want permission denied", name, err)
+		}
+	}
+	if err := command(f, "Rename", "/top.txt", "/data"); !errors.Is(err, sftp.ErrSshFxPermissionDenied) {
+		t.Errorf("rename over a mount point: got %v, want permission denied", err)
+	}
+}
+
+func TestVirtualRoot(t *testing.T) {
+	_, inbox := newVolume()
+	_, archive := newVolume()
+	f := newTestMount(t, nil, Point{Path: "/inbox", FS: inbox}, Point{Path: "/deep/archive", FS: archive})
+
+	if got := list(t, f, "/"); got != "deep/ inbox/" {
+		t.Fatalf("list / = %q", got)
+	}
+	if got := list(t, f, "/deep"); got != "archive/" {
+		t.Fatalf("list /deep = %q", got)
+	}
+	for _, name := range []string{"/", "/deep", "/deep/archive"} {
+		lister, err := f.Filelist(sftp.NewRequest("Stat", name))
+		if err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		if infos := lister.(fs2.ListerAt); len(infos) != 1 || !infos[0].IsDir() {
+			t.Fatalf("stat %s = %v, want a folder", name, infos)
+		}
+	}
+	if _, err := f.Filelist(sftp.NewRequest("List", "/missing")); !errors.Is(err, sftp.ErrSshFxNoSuchFile) {
+		t.Fatalf("list outside of the mount points: got %v, want no such file", err)
+	}
+	if _, err := f.Filewrite(sftp.NewRequest("Put", "/file.txt")); !errors.Is(err, sftp.ErrSshFxPermissionDenied) {
+		t.Fatalf("write to the virtual root: got %v, want permission denied", err)
+	}
+	if err := command(f, "Mkdir", "/dir", ""); !errors.Is(err, sftp.ErrSshFxPermissionDenied) {
+		t.Fatalf("mkdir in the virtual root: got %v, want permission denied", err)
+	}
+	if err := command(f, "Rmdir", "/deep", ""); !errors.Is(err, sftp.ErrSshFxPermissionDenied) {
+		t.Fatalf("rmdir of a folder leading to a mount point: got %v, want permission denied", err)
+	}
+}
+
+func TestRenameAcrossMounts(t *testing.T) {
+	root, rootFS := newVolume()
+	archive, archiveFS := newVolume()
+	f := newTestMount(t, rootFS, Point{Path: "/archive", FS: archiveFS})
+
+	write(t, f, "/report.csv", "a,b")
+	if err := command(f, "Rename", "/report.csv", "/archive/report.csv"); err != nil {
+		t.Fatalf("rename file: %v", err)
+	}
+	if exists(t, root, "/report.csv") || read(t, archiveFS, "/report.csv") != "a,b" {
+		t.Fatal("file not moved to the archive")
+	}
+
+	write(t, f, "/dir/a.txt", "a")
+	write(t, f, "/dir/sub/b.txt", "b")
+	if err := command(f, "Rename", "/dir", "/archive/2024"); err != nil {
+		t.Fatalf("rename folder: %v", err)
+	}
+	if exists(t, root, "/dir") {
+		t.Fatal("source folder kept")
+	}
+	if read(t, f, "/archive/2024/a.txt") != "a" || read(t, f, "/archive/2024/sub/b.txt") != "b" {
+		t.Fatal("folder not copied to the archive")
+	}
+
+	// Renames within one filesystem are passed through.
+	if err := command(f, "Rename", "/archive/report.csv", "/archive/2024/report.csv"); err != nil {
+		t.Fatalf("rename within a mount: %v", err)
+	}
+	if !exists(t, archive, "/2024/report.csv") || exists(t, archive, "/report.csv") {
+		t.Fatal("file not renamed within the archive")
+	}
+	if err := command(f, "Rename", "/archive/2024/report.csv", "/report.csv"); err != nil {
+		t.Fatalf("rename back: %v", err)
+	}
+	if read(t, rootFS, "/report.csv") != "a,b" {
+		t.Fatal("file not moved back to the root")
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, a := newVolume()
+	_, b := newVolume()
+	for _, tt := range []struct {
+		name   string
+		points []Point
+	}{
+		{"root", []Point{{Path: "/", FS: a}}},
+		{"duplicate", []Point{{Path: "/a", FS: a}, {Path: "/a/", FS: b}}},
+		{"without filesystem", []Point{{Path: "/a"}}},
+	} {
+		if _, err := New(nil, tt.points...); err == nil {
+			t.Errorf("%s: mount accepted", tt.name)
+		}
+	}
+	f := newTestMount(t, nil, Point{Path: "/a", FS: a}, Point{Path: "/a/b/c", FS: b})
+	if points := f.(*FS).Points(); points[0].Path != "/a/b/c" || points[1].Path != "/a" {
+		t.Fatalf("points = %v, want the longest first", points)
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"io"
 	"os"
+	"path"
 	"strings"
 	
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
 	"golang.org/x/crypto/ssh"
 	
 	fs2 "github.com/oarkflow/sftp/pkg/fs"
@@ -42,7 +44,7 @@ func (f *Fs) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 	}
 	switch request.Method {
 	case "Get":
-		key := strings.TrimPrefix(request.Filepath, "/")
+		key := strings.TrimPrefix(f.key(request.Filepath), "/")
 		object, err := f.client.GetObject(context.Background(), &s3.GetObjectInput{
 			Bucket: aws.String(f.bucket),
 			Key:    aws.String(key),
@@ -62,7 +64,7 @@ func (f *Fs) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	}
 	switch request.Method {
 	case "Put":
-		return newWriter(context.Background(), f.client, f.bucket, strings.TrimPrefix(request.Filepath, "/"))
+		return newWriter(context.Background(), f.client, f.bucket, strings.TrimPrefix(f.key(request.Filepath), "/"))
 	default:
 		return nil, sftp.ErrSSHFxOpUnsupported
 	}
@@ -72,8 +74,8 @@ func (f *Fs) Filecmd(request *sftp.Request) error {
 	if f.readOnly {
 		return sftp.ErrSshFxOpUnsupported
 	}
-	p := request.Filepath
-	target := request.Target
+	p := f.key(request.Filepath)
+	target := f.key(request.Target)
 	switch request.Method {
 	case "Setstat":
 		if !fs2.Can(f.permissions, fs2.Update) {
@@ -154,7 +156,7 @@ func (f *Fs) Filecmd(request *sftp.Request) error {
 }
 
 func (f *Fs) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
-	p := request.Filepath
+	p := f.key(request.Filepath)
 	switch request.Method {
 	case "List":
 		if !fs2.Can(f.permissions, fs2.Read) {
@@ -218,6 +220,21 @@ type Option struct {
 	Bucket    string `json:"bucket"`
 	AccessKey string `json:"access_key"`
 	Secret    string `json:"secret"`
+	// Prefix confines the user to the keys below it, e.g. "tenants/42".
+	Prefix string `json:"prefix"`
+}
+
+func init() {
+	fs2.RegisterBackend("s3", func(params map[string]any) (fs2.FS, error) {
+		opt := Option{Region: "us-east-1"}
+		if err := fs2.DecodeParams("s3", params, &opt); err != nil {
+			return nil, err
+		}
+		if err := fs2.RequireParam("s3", "bucket", opt.Bucket); err != nil {
+			return nil, err
+		}
+		return New(opt)
+	})
 }
 
 func New(opt Option) (fs2.FS, error) {
@@ -235,5 +252,32 @@ func New(opt Option) (fs2.FS, error) {
 	}
 	
 	s3Fs := NewFsFromConfig(opt.Bucket, conf)
+	s3Fs.prefix = strings.Trim(opt.Prefix, "/")
 	return s3Fs, nil
 }
+
+// Prefix returns the key prefix the user is confined to, without slashes around it.
+func (f *Fs) Prefix() string {
+	return f.prefix
+}
+
+// Home returns the prefix directory of the bucket, or no root without a prefix.
+func (f *Fs) Home() (afero.Fs, string) {
+	if f.prefix == "" {
+		return f, ""
+	}
+	return f, "/" + f.prefix + "/"
+}
+
+// key maps a path of the SFTP request below the prefix. The path is cleaned first so that
+// it cannot escape the prefix; the root maps to the prefix directory.
+func (f *Fs) key(p string) string {
+	if f.prefix == "" || p == "" {
+		return p
+	}
+	clean := path.Clean("/" + p)
+	if clean == "/" {
+		return "/" + f.prefix + "/"
+	}
+	return path.Join("/", f.prefix, clean)
+}
@@ -32,6 +32,7 @@ type Fs struct {
 	client      *s3.Client
 	id          string
 	bucket      string // Bucket name
+	prefix      string // Prefix of the keys exposed through SFTP
 	permissions int64
 	readOnly    bool
 	ctx         map[string]string
@@ -0,0 +1,251 @@
+package sftpfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+)
+
+// pool shares connections to one upstream server between sessions. Connections are handed
+// out round robin, dialed again once they are lost and closed once the pool was unused for
+// its idle timeout, which also removes the pool from pools.
+type pool struct {
+	key         string
+	address     string
+	config      *ssh.ClientConfig
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	slots       []slot
+	next        int
+	// active counts the operations running and the files open on the connections.
+	active   int
+	lastUsed time.Time
+	idle     *time.Timer
+}
+
+// slot holds a connection of the pool, or the dial of one in progress.
+type slot struct {
+	client  *client
+	dialing *dialCall
+}
+
+// dialCall is a dial shared by the operations waiting for the same slot.
+type dialCall struct {
+	done   chan struct{}
+	client *client
+	err    error
+}
+
+type client struct {
+	conn *ssh.Client
+	sftp *sftp.Client
+	done chan struct{}
+}
+
+func (c *client) alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *client) close() {
+	c.sftp.Close()
+	c.conn.Close()
+}
+
+var (
+	poolsMu sync.Mutex
+	pools   = make(map[string]*pool)
+)
+
+// poolFor returns the pool of the connection params of opt, creating it when missing.
+func poolFor(opt Option, config *ssh.ClientConfig) (*pool, error) {
+	idleTimeout := DefaultIdleTimeout
+	if opt.IdleTimeout != "" {
+		var err error
+		if idleTimeout, err = time.ParseDuration(opt.IdleTimeout); err != nil {
+			return nil, errs.BackendParamsError{Backend: "sftp", Param: "idle_timeout", Err: err}
+		}
+	}
+	// Filesystems only differing by their root share connections.
+	opt.Root = ""
+	data, err := json.Marshal(opt)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	p, exists := pools[key]
+	if !exists {
+		p = &pool{key: key, address: opt.Address, config: config, idleTimeout: idleTimeout, slots: make([]slot, opt.MaxConns)}
+		pools[key] = p
+	}
+	return p, nil
+}
+
+// acquire keeps the connections of the pool open until the matching release.
+func (p *pool) acquire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active++
+}
+
+// release ends a use of the pool and closes its connections once it stays unused for the
+// idle timeout.
+func (p *pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	p.lastUsed = time.Now()
+	if p.active > 0 || p.idleTimeout <= 0 {
+		return
+	}
+	if p.idle == nil {
+		p.idle = time.AfterFunc(p.idleTimeout, p.closeIdle)
+	} else {
+		p.idle.Reset(p.idleTimeout)
+	}
+}
+
+// closeIdle closes the connections of an unused pool and forgets it, so pools of configs
+// no longer used, such as templated credentials, do not stay around. Filesystems still
+// holding the pool dial again on their next operation.
+func (p *pool) closeIdle() {
+	poolsMu.Lock()
+	p.mu.Lock()
+	if p.active > 0 || time.Since(p.lastUsed) < p.idleTimeout {
+		p.mu.Unlock()
+		poolsMu.Unlock()
+		return
+	}
+	if pools[p.key] == p {
+		delete(pools, p.key)
+	}
+	poolsMu.Unlock()
+	var idle []*client
+	for i := range p.slots {
+		if c := p.slots[i].client; c != nil {
+			idle = append(idle, c)
+			p.slots[i].client = nil
+		}
+	}
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.close()
+	}
+}
+
+// get returns the connection of the next slot. A lost connection is dialed again without
+// holding the lock of the pool; operations picking the same slot meanwhile share the dial.
+func (p *pool) get() (*client, error) {
+	p.mu.Lock()
+	s := &p.slots[p.next]
+	p.next = (p.next + 1) % len(p.slots)
+	if c := s.client; c != nil && c.alive() {
+		p.mu.Unlock()
+		return c, nil
+	}
+	lost := s.client
+	s.client = nil
+	call := s.dialing
+	if call != nil {
+		p.mu.Unlock()
+		<-call.done
+		return call.client, call.err
+	}
+	call = &dialCall{done: make(chan struct{})}
+	s.dialing = call
+	p.mu.Unlock()
+	if lost != nil {
+		lost.close()
+	}
+	call.client, call.err = p.dial()
+	p.mu.Lock()
+	s.dialing = nil
+	if call.err == nil {
+		s.client = call.client
+	}
+	p.mu.Unlock()
+	close(call.done)
+	return call.client, call.err
+}
+
+func (p *pool) dial() (*client, error) {
+	conn, err := ssh.Dial("tcp", p.address, p.config)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &client{conn: conn, sftp: sc, done: make(chan struct{})}
+	go func() {
+		sc.Wait()
+		close(c.done)
+	}()
+	return c, nil
+}
+
+// drop closes a lost connection and frees its slot.
+func (p *pool) drop(c *client) {
+	p.mu.Lock()
+	for i := range p.slots {
+		if p.slots[i].client == c {
+			p.slots[i].client = nil
+		}
+	}
+	p.mu.Unlock()
+	c.close()
+}
+
+// do runs fn with a pooled connection. A lost connection is dropped so the next operation
+// dials a new one; fn itself only runs again when retry is set, for reads that are safe to
+// repeat. Commands such as a rename may have been applied before the connection was lost.
+func (p *pool) do(retry bool, fn func(*sftp.Client) error) error {
+	p.acquire()
+	defer p.release()
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+	err = fn(c.sftp)
+	if err == nil || (c.alive() && !errors.Is(err, sftp.ErrSSHFxConnectionLost)) {
+		return err
+	}
+	p.drop(c)
+	if !retry {
+		return err
+	}
+	if c, err = p.get(); err != nil {
+		return err
+	}
+	return fn(c.sftp)
+}
+
+// file is an upstream file keeping the connections of its pool open until it is closed.
+type file struct {
+	*sftp.File
+	release sync.Once
+	pool    *pool
+}
+
+func (f *file) Close() error {
+	err := f.File.Close()
+	f.release.Do(f.pool.release)
+	return err
+}
@@ -0,0 +1,36 @@
+package sftpfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoolRemovedWhenIdle(t *testing.T) {
+	opt := Option{Address: "127.0.0.1:1", Username: "user", MaxConns: 1, IdleTimeout: "20ms"}
+	p, err := poolFor(opt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt.Root = "/other"
+	if shared, _ := poolFor(opt, nil); shared != p {
+		t.Fatal("filesystems only differing by their root do not share the pool")
+	}
+	p.acquire()
+	p.release()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		poolsMu.Lock()
+		_, exists := pools[p.key]
+		poolsMu.Unlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle pool not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fresh, _ := poolFor(opt, nil); fresh == p {
+		t.Fatal("removed pool handed out again")
+	}
+}
@@ -0,0 +1,337 @@
+package sftpfs_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+
+	server "github.com/oarkflow/sftp"
+	fs2 "github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/fs/memory"
+	"github.com/oarkflow/sftp/pkg/fs/sftpfs"
+	"github.com/oarkflow/sftp/pkg/models"
+	"github.com/oarkflow/sftp/pkg/providers"
+)
+
+var allPermissions = []string{"read", "read-content", "create", "update", "delete"}
+
+// testUpstream is an instance of this server serving a memory volume on a loopback port.
+// Its connections are tracked, and dropped while a request runs when it is asked to crash,
+// like an upstream crashing after applying the request but before replying.
+type testUpstream struct {
+	address string
+	volume  *memory.Volume
+	mu      sync.Mutex
+	conns   map[*trackedConn]bool
+	dials   int
+	calls   map[string]int
+	crash   map[string]int
+}
+
+func newTestUpstream(t *testing.T) *testUpstream {
+	t.Helper()
+	u := &testUpstream{
+		volume: memory.NewVolume(),
+		conns:  make(map[*trackedConn]bool),
+		calls:  make(map[string]int),
+		crash:  make(map[string]int),
+	}
+	volume := "sftpfs-" + t.Name()
+	memory.Register(volume, u.volume)
+	hash, err := providers.HashPassword("secret", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(
+		server.WithBasePath(t.TempDir()),
+		server.WithHostKeys("ssh_host_ed25519_key"),
+		server.WithNotificationCallback(u.notify),
+	)
+	err = srv.AddUser(models.User{
+		Username:    "upstream",
+		Password:    hash,
+		Filesystems: []*models.Filesystem{{Fs: "memory", Permissions: allPermissions, Params: map[string]any{"volume": volume}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.address = l.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Serve(ctx, &trackedListener{Listener: l, upstream: u})
+	}()
+	t.Cleanup(func() {
+		cancel()
+		u.dropAll()
+		<-done
+	})
+	return u
+}
+
+// notify records a request handled by the server and drops the connections when it is asked
+// to crash. Notifications are sent before the reply of the request.
+func (u *testUpstream) notify(n server.Notification) error {
+	u.mu.Lock()
+	u.calls[n.Event]++
+	crash := u.crash[n.Event] > 0
+	if crash {
+		u.crash[n.Event]--
+	}
+	u.mu.Unlock()
+	if crash {
+		u.dropAll()
+	}
+	return nil
+}
+
+func (u *testUpstream) crashOn(method string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.crash[method]++
+}
+
+func (u *testUpstream) dropAll() {
+	u.mu.Lock()
+	conns := make([]*trackedConn, 0, len(u.conns))
+	for conn := range u.conns {
+		conns = append(conns, conn)
+	}
+	u.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (u *testUpstream) stats() (dials, open int, calls map[string]int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	calls = make(map[string]int, len(u.calls))
+	for method, n := range u.calls {
+		calls[method] = n
+	}
+	return u.dials, len(u.conns), calls
+}
+
+// trackedListener counts the connections the pool dials and keeps them until closed.
+type trackedListener struct {
+	net.Listener
+	upstream *testUpstream
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &trackedConn{Conn: conn, upstream: l.upstream}
+	l.upstream.mu.Lock()
+	l.upstream.conns[c] = true
+	l.upstream.dials++
+	l.upstream.mu.Unlock()
+	return c, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	upstream *testUpstream
+	close    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.close.Do(func() {
+		c.upstream.mu.Lock()
+		delete(c.upstream.conns, c)
+		c.upstream.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func newTestFs(t *testing.T, u *testUpstream, opt sftpfs.Option) fs2.FS {
+	t.Helper()
+	opt.Address = u.address
+	opt.Username = "upstream"
+	opt.Password = "secret"
+	opt.InsecureIgnoreHostKey = true
+	f, err := sftpfs.New(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetPermissions(allPermissions)
+	return f
+}
+
+func command(f fs2.FS, method, name string) error {
+	if err := f.Filecmd(sftp.NewRequest(method, name)); !errors.Is(err, sftp.ErrSshFxOk) {
+		return err
+	}
+	return nil
+}
+
+func stat(f fs2.FS, name string) error {
+	_, err := f.Filelist(sftp.NewRequest("Stat", name))
+	return err
+}
+
+func TestPoolTransfers(t *testing.T) {
+	u := newTestUpstream(t)
+	if err := u.volume.Afero().Mkdir("/data", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f := newTestFs(t, u, sftpfs.Option{Root: "/data", MaxConns: 2})
+
+	// Operations waiting for a connection share its dial.
+	var wg sync.WaitGroup
+	results := make(chan error, 8)
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- command(f, "Mkdir", "/in")
+		}()
+	}
+	wg.Wait()
+	close(results)
+	for err := range results {
+		if err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if dials, _, _ := u.stats(); dials != 2 {
+		t.Fatalf("%d dials, want one per connection of the pool", dials)
+	}
+
+	w, err := f.Filewrite(sftp.NewRequest("Put", "/in/a.txt"))
+	if err != nil {
+		t.Fatalf("open for writing: %v", err)
+	}
+	if _, err := w.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size := u.volume.Size(); size != 5 {
+		t.Fatalf("upstream volume holds %d bytes, want the 5 written", size)
+	}
+	r, err := f.Fileread(sftp.NewRequest("Get", "/in/a.txt"))
+	if err != nil {
+		t.Fatalf("open for reading: %v", err)
+	}
+	data := make([]byte, 5)
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if err := r.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("read %q, want hello", data)
+	}
+	lister, err := f.Filelist(sftp.NewRequest("List", "/in"))
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if files, ok := lister.(fs2.ListerAt); !ok || len(files) != 1 || files[0].Name() != "a.txt" {
+		t.Fatalf("listed %v, want a.txt", lister)
+	}
+}
+
+func TestPoolConnectionLost(t *testing.T) {
+	u := newTestUpstream(t)
+	f := newTestFs(t, u, sftpfs.Option{MaxConns: 1})
+	if err := command(f, "Mkdir", "/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads are repeated on a new connection.
+	_, _, before := u.stats()
+	u.crashOn("Stat")
+	if err := stat(f, "/a"); err != nil {
+		t.Fatalf("stat through a lost connection: %v", err)
+	}
+	if dials, _, calls := u.stats(); dials != 2 || calls["Stat"]-before["Stat"] != 2 {
+		t.Fatalf("%d dials and %d stats, want the stat repeated on a new connection", dials, calls["Stat"]-before["Stat"])
+	}
+
+	// Commands may have been applied upstream, they are not.
+	u.crashOn("Rename")
+	request := sftp.NewRequest("Rename", "/a")
+	request.Target = "/c"
+	if err := f.Filecmd(request); errors.Is(err, sftp.ErrSshFxOk) {
+		t.Fatal("rename through a lost connection succeeded")
+	}
+	if _, _, calls := u.stats(); calls["Rename"] != 1 {
+		t.Fatalf("rename ran %d times upstream, want 1", calls["Rename"])
+	}
+	if exists, _ := afero.DirExists(u.volume.Afero(), "/c"); !exists {
+		t.Fatal("rename not applied upstream before the connection was lost")
+	}
+	if err := command(f, "Mkdir", "/b"); err != nil {
+		t.Fatalf("command after a lost connection: %v", err)
+	}
+	if dials, _, _ := u.stats(); dials != 3 {
+		t.Fatalf("%d dials, want the lost connection dialed again", dials)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	u := newTestUpstream(t)
+	f := newTestFs(t, u, sftpfs.Option{MaxConns: 1, IdleTimeout: "50ms"})
+	r, err := func() (io.ReaderAt, error) {
+		w, err := f.Filewrite(sftp.NewRequest("Put", "/a.txt"))
+		if err != nil {
+			return nil, err
+		}
+		if err := w.(io.Closer).Close(); err != nil {
+			return nil, err
+		}
+		return f.Fileread(sftp.NewRequest("Get", "/a.txt"))
+	}()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Open files keep the connection.
+	time.Sleep(150 * time.Millisecond)
+	if _, open, _ := u.stats(); open != 1 {
+		t.Fatalf("%d open connections while a file is open, want 1", open)
+	}
+	if err := r.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, open, _ := u.stats()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Filesystems keep working once their pool was closed and forgotten.
+	if err := stat(f, "/a.txt"); err != nil {
+		t.Fatalf("stat after the idle timeout: %v", err)
+	}
+	if dials, _, _ := u.stats(); dials != 2 {
+		t.Fatalf("%d dials, want the closed connection dialed again", dials)
+	}
+	if _, err := sftpfs.New(sftpfs.Option{Address: u.address, Username: "upstream", Password: "secret", InsecureIgnoreHostKey: true, IdleTimeout: "soon"}); err == nil || !strings.Contains(err.Error(), "idle_timeout") {
+		t.Fatalf("got %v, want an invalid idle_timeout", err)
+	}
+}
@@ -0,0 +1,408 @@
+// Package sftpfs forwards the requests of users to an upstream SFTP server, fronting it
+// with the authentication, audit and notifications of this server.
+package sftpfs
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	fs2 "github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/log"
+)
+
+const (
+	DefaultTimeout     = 10 * time.Second
+	DefaultIdleTimeout = 5 * time.Minute
+	DefaultMaxConns    = 2
+)
+
+// Option is the params of the "sftp" backend. The upstream host key is verified with a
+// known_hosts file or a single authorized_keys formatted key; skipping the verification
+// has to be asked for explicitly.
+type Option struct {
+	// Address of the upstream server, the port defaults to 22.
+	Address        string `json:"address"`
+	Username       string `json:"username"`
+	Password       string `json:"password"`
+	PrivateKey     string `json:"private_key"`
+	PrivateKeyFile string `json:"private_key_file"`
+	Passphrase     string `json:"passphrase"`
+	KnownHosts     string `json:"known_hosts"`
+	HostKey        string `json:"host_key"`
+	// InsecureIgnoreHostKey accepts any upstream host key, for tests only.
+	InsecureIgnoreHostKey bool `json:"insecure_ignore_host_key"`
+	// Root is the upstream folder the user is confined to, "/" by default. Relative roots
+	// are resolved against the upstream home directory.
+	Root string `json:"root"`
+	// Timeout of the connection to the upstream server, e.g. "30s".
+	Timeout string `json:"timeout"`
+	// MaxConns is the number of connections shared by the sessions using the same upstream
+	// server and credentials.
+	MaxConns int `json:"max_conns"`
+	// IdleTimeout closes the shared connections once no session used them for its duration,
+	// e.g. "1m". Defaults to DefaultIdleTimeout.
+	IdleTimeout string `json:"idle_timeout"`
+}
+
+func init() {
+	fs2.RegisterBackend("sftp", func(params map[string]any) (fs2.FS, error) {
+		var opt Option
+		if err := fs2.DecodeParams("sftp", params, &opt); err != nil {
+			return nil, err
+		}
+		return New(opt)
+	})
+}
+
+// New returns a filesystem forwarding requests to the upstream server of opt. Connections
+// are dialed on first use and kept open until they are idle.
+func New(opt Option) (fs2.FS, error) {
+	config, err := clientConfig(&opt)
+	if err != nil {
+		return nil, err
+	}
+	p, err := poolFor(opt, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Fs{pool: p, root: opt.Root}, nil
+}
+
+// clientConfig validates opt, applies its defaults and builds the SSH client configuration.
+func clientConfig(opt *Option) (*ssh.ClientConfig, error) {
+	if err := fs2.RequireParam("sftp", "address", opt.Address); err != nil {
+		return nil, err
+	}
+	if err := fs2.RequireParam("sftp", "username", opt.Username); err != nil {
+		return nil, err
+	}
+	if _, _, err := net.SplitHostPort(opt.Address); err != nil {
+		opt.Address = net.JoinHostPort(opt.Address, "22")
+	}
+	if opt.Root == "" {
+		opt.Root = "/"
+	}
+	if opt.MaxConns <= 0 {
+		opt.MaxConns = DefaultMaxConns
+	}
+	timeout := DefaultTimeout
+	if opt.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(opt.Timeout); err != nil {
+			return nil, errs.BackendParamsError{Backend: "sftp", Param: "timeout", Err: err}
+		}
+	}
+	var auth []ssh.AuthMethod
+	key := []byte(opt.PrivateKey)
+	if opt.PrivateKeyFile != "" {
+		var err error
+		if key, err = os.ReadFile(opt.PrivateKeyFile); err != nil {
+			return nil, errs.BackendParamsError{Backend: "sftp", Param: "private_key_file", Err: err}
+		}
+	}
+	if len(key) > 0 {
+		var signer ssh.Signer
+		var err error
+		if opt.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(opt.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, errs.BackendParamsError{Backend: "sftp", Param: "private_key", Err: err}
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if opt.Password != "" {
+		auth = append(auth, ssh.Password(opt.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errs.BackendParamsError{Backend: "sftp", Param: "password", Err: errors.New("a password or a private key is required")}
+	}
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case opt.KnownHosts != "":
+		var err error
+		if hostKeyCallback, err = knownhosts.New(opt.KnownHosts); err != nil {
+			return nil, errs.BackendParamsError{Backend: "sftp", Param: "known_hosts", Err: err}
+		}
+	case opt.HostKey != "":
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(opt.HostKey))
+		if err != nil {
+			return nil, errs.BackendParamsError{Backend: "sftp", Param: "host_key", Err: err}
+		}
+		hostKeyCallback = ssh.FixedHostKey(hostKey)
+	case opt.InsecureIgnoreHostKey:
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errs.BackendParamsError{Backend: "sftp", Param: "known_hosts", Err: errors.New("known_hosts or host_key is required")}
+	}
+	return &ssh.ClientConfig{
+		User:            opt.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}, nil
+}
+
+// Fs forwards the requests of a session to the upstream server.
+type Fs struct {
+	pool        *pool
+	root        string
+	logger      log.Logger
+	id          string
+	permissions int64
+	ctx         map[string]string
+	sconn       *ssh.ServerConn
+}
+
+func (f *Fs) SetPermissions(p []string) {
+	f.permissions = fs2.Serialize(p)
+}
+
+func (f *Fs) Permissions() []string {
+	return fs2.Deserialize(f.permissions)
+}
+
+func (f *Fs) SetID(p string) {
+	f.id = p
+}
+
+func (f *Fs) SetContext(ctx map[string]string) {
+	f.ctx = ctx
+}
+
+func (f *Fs) Context() map[string]string {
+	return f.ctx
+}
+
+func (f *Fs) SetLogger(logger log.Logger) {
+	f.logger = logger
+}
+
+func (f *Fs) Logger() log.Logger {
+	return f.logger
+}
+
+func (f *Fs) SetConn(sconn *ssh.ServerConn) {
+	f.sconn = sconn
+}
+
+func (f *Fs) Conn() *ssh.ServerConn {
+	return f.sconn
+}
+
+func (f *Fs) Type() string {
+	return "sftp"
+}
+
+// remote maps the path of a request below the upstream root.
+func (f *Fs) remote(p string) string {
+	return path.Join(f.root, path.Clean("/"+p))
+}
+
+// fail translates an error of the upstream server to an SFTP status, logging unexpected ones.
+func (f *Fs) fail(msg string, p string, err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return sftp.ErrSshFxNoSuchFile
+	case errors.Is(err, os.ErrPermission):
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if f.logger != nil {
+		f.logger.Error(msg, "source", p, "err", err)
+	}
+	return sftp.ErrSshFxFailure
+}
+
+// Fileread opens the upstream file for reading.
+func (f *Fs) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	if !fs2.Can(f.permissions, fs2.ReadContent) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+	p := f.remote(request.Filepath)
+	var upstream *sftp.File
+	f.pool.acquire()
+	err := f.pool.do(true, func(c *sftp.Client) (err error) {
+		upstream, err = c.Open(p)
+		return err
+	})
+	if err != nil {
+		f.pool.release()
+		return nil, f.fail("could not open file for reading", p, err)
+	}
+	return &file{File: upstream, pool: f.pool}, nil
+}
+
+// Filewrite opens the upstream file for writing, creating it along with its parent
+// directories when it does not exist.
+func (f *Fs) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	p := f.remote(request.Filepath)
+	var upstream *sftp.File
+	f.pool.acquire()
+	err := f.pool.do(false, func(c *sftp.Client) error {
+		stat, err := c.Stat(p)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			if !fs2.Can(f.permissions, fs2.Create) {
+				return os.ErrPermission
+			}
+			if err := c.MkdirAll(path.Dir(p)); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case stat.IsDir():
+			return sftp.ErrSshFxOpUnsupported
+		case !fs2.Can(f.permissions, fs2.Update):
+			return os.ErrPermission
+		}
+		upstream, err = c.OpenFile(p, openFlags(request))
+		return err
+	})
+	if err != nil {
+		f.pool.release()
+		if errors.Is(err, sftp.ErrSshFxOpUnsupported) {
+			return nil, err
+		}
+		return nil, f.fail("error opening file for writing", p, err)
+	}
+	return &file{File: upstream, pool: f.pool}, nil
+}
+
+// openFlags maps the SFTP open flags of request to os.OpenFile flags.
+func openFlags(request *sftp.Request) int {
+	if request.Flags == 0 {
+		return os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	pflags := request.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return flags
+}
+
+// Filecmd forwards the SFTP commands on files and directories upstream.
+func (f *Fs) Filecmd(request *sftp.Request) error {
+	p := f.remote(request.Filepath)
+	target := f.remote(request.Target)
+	var permission string
+	var cmd func(c *sftp.Client) error
+	switch request.Method {
+	case "Setstat":
+		permission = fs2.Update
+		cmd = func(c *sftp.Client) error {
+			return setstat(c, request, p)
+		}
+	case "Rename":
+		permission = fs2.Update
+		cmd = func(c *sftp.Client) error {
+			return c.Rename(p, target)
+		}
+	case "Rmdir":
+		if path.Clean("/"+request.Filepath) == "/" {
+			return sftp.ErrSshFxPermissionDenied
+		}
+		permission = fs2.Delete
+		cmd = func(c *sftp.Client) error {
+			return c.RemoveAll(p)
+		}
+	case "Mkdir":
+		permission = fs2.Create
+		cmd = func(c *sftp.Client) error {
+			return c.MkdirAll(p)
+		}
+	case "Symlink":
+		permission = fs2.Create
+		cmd = func(c *sftp.Client) error {
+			return c.Symlink(p, target)
+		}
+	case "Remove":
+		permission = fs2.Delete
+		cmd = func(c *sftp.Client) error {
+			return c.Remove(p)
+		}
+	default:
+		return sftp.ErrSshFxOpUnsupported
+	}
+	if !fs2.Can(f.permissions, permission) {
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if err := f.pool.do(false, cmd); err != nil {
+		return f.fail("failed to run "+request.Method+" upstream", p, err)
+	}
+	return sftp.ErrSshFxOk
+}
+
+// setstat applies the attributes sent by the client. Ownership changes are ignored.
+func setstat(c *sftp.Client, request *sftp.Request, p string) error {
+	flags := request.AttrFlags()
+	attrs := request.Attributes()
+	if flags.Permissions {
+		mode := attrs.FileMode().Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := c.Chmod(p, mode); err != nil {
+			return err
+		}
+	}
+	if flags.Size {
+		if err := c.Truncate(p, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		return c.Chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0))
+	}
+	return nil
+}
+
+// Filelist lists the contents of an upstream directory or stats an upstream file.
+func (f *Fs) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	if !fs2.Can(f.permissions, fs2.Read) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+	p := f.remote(request.Filepath)
+	var files []os.FileInfo
+	var err error
+	switch request.Method {
+	case "List":
+		err = f.pool.do(true, func(c *sftp.Client) (err error) {
+			files, err = c.ReadDir(p)
+			return err
+		})
+	case "Stat":
+		err = f.pool.do(true, func(c *sftp.Client) error {
+			s, err := c.Stat(p)
+			files = []os.FileInfo{s}
+			return err
+		})
+	default:
+		// Upstream links could point outside the root of the user.
+		return nil, sftp.ErrSshFxOpUnsupported
+	}
+	if err != nil {
+		return nil, f.fail("failed to run "+request.Method+" upstream", p, err)
+	}
+	return fs2.ListerAt(files), nil
+}
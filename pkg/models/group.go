@@ -0,0 +1,101 @@
+package models
+
+// Group holds settings shared by its members. Members inherit them through User.Groups and
+// ResolveGroups.
+type Group struct {
+	Name              string        `json:"name"`
+	Permissions       []string      `json:"permissions"`
+	Filesystems       []*Filesystem `json:"filesystems"`
+	DefaultFilesystem string        `json:"default_filesystem"`
+	TwoFactor         TwoFactorMode `json:"two_factor"`
+	MaxSessions       int           `json:"max_sessions"`
+	AllowedIPs        []string      `json:"allowed_ips"`
+	DeniedIPs         []string      `json:"denied_ips"`
+}
+
+// ResolveGroups returns the effective user once the settings of its groups are merged in.
+// Groups are applied in the order of User.Groups and unknown groups are ignored. The user
+// overrides its groups:
+//   - permissions and allowed IPs of the user replace the ones of the groups when set,
+//     otherwise the groups ones are combined;
+//   - filesystems of the user come first and replace group filesystems of the same type,
+//     or mounted at the same folder;
+//   - the default filesystem, two factor mode and session limit of the user win when set,
+//     otherwise the first group setting them wins;
+//   - denied IPs of the user and all its groups are combined.
+func (u User) ResolveGroups(groups map[string]Group) User {
+	if len(u.Groups) == 0 {
+		return u
+	}
+	resolved := u
+	var permissions, allowedIPs []string
+	deniedIPs := append([]string(nil), u.DeniedIPs...)
+	filesystems := append([]*Filesystem(nil), u.Filesystems...)
+	seen := make(map[string]struct{}, len(filesystems))
+	for _, fs := range filesystems {
+		if fs != nil {
+			seen[fs.key()] = struct{}{}
+		}
+	}
+	for _, name := range u.Groups {
+		group, exists := groups[name]
+		if !exists {
+			continue
+		}
+		permissions = append(permissions, group.Permissions...)
+		allowedIPs = append(allowedIPs, group.AllowedIPs...)
+		deniedIPs = append(deniedIPs, group.DeniedIPs...)
+		for _, fs := range group.Filesystems {
+			if fs == nil {
+				continue
+			}
+			if _, exists := seen[fs.key()]; exists {
+				continue
+			}
+			seen[fs.key()] = struct{}{}
+			filesystems = append(filesystems, fs)
+		}
+		if resolved.DefaultFilesystem == "" {
+			resolved.DefaultFilesystem = group.DefaultFilesystem
+		}
+		if resolved.TwoFactor == TwoFactorNone {
+			resolved.TwoFactor = group.TwoFactor
+		}
+		if resolved.MaxSessions == 0 {
+			resolved.MaxSessions = group.MaxSessions
+		}
+	}
+	if len(resolved.Permissions) == 0 {
+		resolved.Permissions = Unique(permissions)
+	}
+	if len(resolved.AllowedIPs) == 0 {
+		resolved.AllowedIPs = Unique(allowedIPs)
+	}
+	resolved.DeniedIPs = Unique(deniedIPs)
+	resolved.Filesystems = filesystems
+	return resolved
+}
+
+// key identifies the filesystems a user replaces group filesystems with.
+func (f *Filesystem) key() string {
+	if f.Mount != "" {
+		return "mount:" + f.Mount
+	}
+	return f.Fs
+}
+
+// Unique returns values without duplicates, keeping the first occurrence of each value.
+func Unique(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	seen := make(map[string]struct{}, len(values))
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if _, exists := seen[value]; !exists {
+			seen[value] = struct{}{}
+			result = append(result, value)
+		}
+	}
+	return result
+}
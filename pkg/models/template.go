@@ -0,0 +1,98 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// HomeData is what the server executes filesystem parameter templates with, e.g. a base
+// path of "/srv/sftp/{{.Username}}" or an S3 prefix of "tenants/{{.ID}}".
+type HomeData struct {
+	ID       int64
+	Username string
+}
+
+// Validate rejects usernames that are not a single path element, see ValidateUsername.
+func (d HomeData) Validate() error {
+	return ValidateUsername(d.Username)
+}
+
+// ValidateUsername rejects usernames that are not a single path element, such as "../root"
+// or "alice/private", which would otherwise expand a template like "/srv/sftp/{{.Username}}"
+// to a folder outside of the user's home. Template data holding a username should validate
+// it with this in a Validate method, which ExpandPath calls.
+func ValidateUsername(username string) error {
+	switch {
+	case username == "", username == ".", username == "..":
+		return fmt.Errorf("username %q is not a valid folder name", username)
+	case strings.ContainsAny(username, "/\\\x00"):
+		return fmt.Errorf("username %q contains a path separator", username)
+	}
+	return nil
+}
+
+// Expand returns a copy of the filesystem with its string parameters containing "{{"
+// executed as text/template templates with data, see ExpandPath. Missing keys are errors.
+func (f *Filesystem) Expand(data any) (*Filesystem, error) {
+	expanded := &Filesystem{
+		Fs:          f.Fs,
+		Permissions: f.Permissions,
+		Params:      make(map[string]any, len(f.Params)),
+		Mount:       f.Mount,
+	}
+	for key, val := range f.Params {
+		if s, ok := val.(string); ok && strings.Contains(s, "{{") {
+			executed, err := ExpandPath(key, s, data)
+			if err != nil {
+				return nil, fmt.Errorf("filesystem %s param %s: %w", f.Fs, key, err)
+			}
+			val = executed
+		}
+		expanded.Params[key] = val
+	}
+	return expanded, nil
+}
+
+// ExpandPath executes tmpl with data like ExpandTemplate and makes sure the result stays
+// below the literal text preceding the first action, so that "/srv/sftp/{{.Username}}"
+// cannot expand to a parent of /srv/sftp. Data implementing Validate() error is validated
+// before the template is executed.
+func ExpandPath(name, tmpl string, data any) (string, error) {
+	if v, ok := data.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			return "", err
+		}
+	}
+	executed, err := ExpandTemplate(name, tmpl, data)
+	if err != nil {
+		return "", err
+	}
+	base := tmpl
+	if i := strings.Index(tmpl, "{{"); i >= 0 {
+		base = tmpl[:i]
+	}
+	if !strings.HasPrefix(executed, base) {
+		return "", fmt.Errorf("%s: %q is not below %q", name, executed, base)
+	}
+	for _, elem := range strings.FieldsFunc(executed[len(base):], func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem == ".." {
+			return "", fmt.Errorf("%s: %q leaves %q", name, executed, base)
+		}
+	}
+	return executed, nil
+}
+
+// ExpandTemplate executes the text/template tmpl with data.
+func ExpandTemplate(name, tmpl string, data any) (string, error) {
+	parsed, err := template.New(name).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := parsed.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
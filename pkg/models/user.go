@@ -1,13 +1,24 @@
 package models
 
 import (
+	"bytes"
 	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/utils"
 )
 
 type Filesystem struct {
 	Fs          string         `json:"fs"`
 	Permissions []string       `json:"permissions"`
 	Params      map[string]any `json:"params"`
+	// Mount is the virtual folder, e.g. "/archive", the filesystem is mounted at. Filesystems
+	// without one are candidates for the root of the user, see GetFilesystem.
+	Mount string `json:"mount,omitempty"`
 }
 
 type User struct {
@@ -18,14 +29,144 @@ type User struct {
 	DefaultFilesystem string        `json:"default_filesystem"`
 	Filesystem        *Filesystem   `json:"filesystem"`
 	Permissions       []string      `json:"permissions"`
+	PublicKeys        []string      `json:"public_keys"`
+	Credentials       []Credential  `json:"credentials"`
+	TwoFactor         TwoFactorMode `json:"two_factor"`
+	// Groups names the groups the user inherits settings from, see ResolveGroups.
+	Groups []string `json:"groups,omitempty"`
+	// MaxSessions overrides the server limit of concurrent sessions for the user when set.
+	MaxSessions int `json:"max_sessions"`
+	// AllowedIPs restricts logins to the listed CIDR blocks or addresses when not empty.
+	AllowedIPs []string `json:"allowed_ips"`
+	// DeniedIPs rejects logins from the listed CIDR blocks or addresses.
+	DeniedIPs []string `json:"denied_ips"`
+	// Disabled rejects every login of the user without deleting it.
+	Disabled bool `json:"disabled"`
+	// ExpiresAt rejects logins of the user after the given time.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// PasswordExpiresAt forces the user to set a new password when logging in with a
+	// password after the given time.
+	PasswordExpiresAt *time.Time `json:"password_expires_at,omitempty"`
+}
+
+// CheckStatus returns an error when the account is disabled or expired at now.
+func (u User) CheckStatus(now time.Time) error {
+	if u.Disabled {
+		return errs.AccountDisabledError{Username: u.Username}
+	}
+	if u.ExpiresAt != nil && !now.Before(*u.ExpiresAt) {
+		return errs.AccountExpiredError{Username: u.Username, ExpiredAt: *u.ExpiresAt}
+	}
+	return nil
+}
+
+// PasswordExpired reports whether the user must change the password at now.
+func (u User) PasswordExpired(now time.Time) bool {
+	return u.PasswordExpiresAt != nil && !now.Before(*u.PasswordExpiresAt)
+}
+
+// AllowsIP reports whether the user may log in from ip.
+func (u User) AllowsIP(ip net.IP) (bool, error) {
+	return IPAllowed(ip, u.AllowedIPs, u.DeniedIPs)
+}
+
+// IPAllowed reports whether ip is allowed by an allow and a deny list. The deny list takes
+// precedence and an empty allow list allows every address.
+func IPAllowed(ip net.IP, allowed, denied []string) (bool, error) {
+	if ip == nil {
+		return false, errors.New("unknown remote address")
+	}
+	if matched, err := utils.MatchCIDRs(denied, ip); err != nil || matched {
+		return false, err
+	}
+	if len(allowed) == 0 {
+		return true, nil
+	}
+	return utils.MatchCIDRs(allowed, ip)
+}
+
+// TwoFactorMode defines after which first factor a TOTP code is required.
+type TwoFactorMode string
+
+const (
+	// TwoFactorNone does not require a second factor.
+	TwoFactorNone TwoFactorMode = ""
+	// TwoFactorPassword requires a password followed by a TOTP code, public keys are rejected.
+	TwoFactorPassword TwoFactorMode = "password"
+	// TwoFactorPublicKey requires a public key followed by a TOTP code, passwords are rejected.
+	TwoFactorPublicKey TwoFactorMode = "publickey"
+	// TwoFactorAny requires a TOTP code after any first factor.
+	TwoFactorAny TwoFactorMode = "any"
+)
+
+// RequiresTOTP reports whether a TOTP code is required after authenticating with the given
+// SSH method ("password" or "publickey").
+func (u User) RequiresTOTP(method string) bool {
+	switch u.TwoFactor {
+	case TwoFactorAny:
+		return true
+	case TwoFactorPassword, TwoFactorPublicKey:
+		return string(u.TwoFactor) == method
+	}
+	return false
+}
+
+// AllowsMethod reports whether the user may authenticate with the given SSH method
+// ("password" or "publickey") as first factor. A mode requiring a TOTP code after one method
+// rejects the other, so that the code cannot be skipped by switching methods.
+func (u User) AllowsMethod(method string) bool {
+	switch u.TwoFactor {
+	case TwoFactorPassword, TwoFactorPublicKey:
+		return string(u.TwoFactor) == method
+	}
+	return true
+}
+
+// TOTPSecret returns the base32 encoded RFC 6238 secret stored as a TWO_FACTOR credential
+// for the SFTP integration, or an empty string if the user has none.
+func (u User) TOTPSecret() string {
+	for _, cred := range u.Credentials {
+		if cred.CredentialType != TwoFactor {
+			continue
+		}
+		if cred.Integration == "" || cred.Integration == SFTP {
+			return cred.Credential
+		}
+	}
+	return ""
+}
+
+// HasPublicKey reports whether key matches one of the authorized_keys lines
+// configured for the user. Lines that fail to parse are ignored.
+func (u User) HasPublicKey(key ssh.PublicKey) bool {
+	if key == nil {
+		return false
+	}
+	marshaled := key.Marshal()
+	for _, line := range u.PublicKeys {
+		authorized, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(authorized.Marshal(), marshaled) {
+			return true
+		}
+	}
+	return false
 }
 
 func (u User) GetFilesystem() (*Filesystem, error) {
-	if len(u.Filesystems) == 0 {
+	var filesystems []*Filesystem
+	for _, fs := range u.Filesystems {
+		if fs.Mount == "" {
+			filesystems = append(filesystems, fs)
+		}
+	}
+	if len(filesystems) == 0 {
 		return nil, nil
 	}
 	if u.DefaultFilesystem != "" {
-		for _, fs := range u.Filesystems {
+		for _, fs := range filesystems {
 			if u.DefaultFilesystem == fs.Fs {
 				u.Filesystem = fs
 				break
@@ -36,11 +177,22 @@ func (u User) GetFilesystem() (*Filesystem, error) {
 		}
 	}
 	if u.Filesystem == nil {
-		u.Filesystem = u.Filesystems[0]
+		u.Filesystem = filesystems[0]
 	}
 	return u.Filesystem, nil
 }
 
+// Mounts returns the filesystems mounted at their own virtual folder.
+func (u User) Mounts() []*Filesystem {
+	var mounts []*Filesystem
+	for _, fs := range u.Filesystems {
+		if fs.Mount != "" {
+			mounts = append(mounts, fs)
+		}
+	}
+	return mounts
+}
+
 // TypeCredential is the type of credential used for authentication.
 type TypeCredential string
 
@@ -76,4 +228,21 @@ type Credential struct {
 	Integration    Integration    `json:"integration"`
 	CredentialID   int64          `gorm:"primaryKey" json:"credential_id"`
 	UserID         int64          `json:"user_id"`
+	// Label tells credentials of a user apart, e.g. the machine an API key was issued to.
+	Label string `json:"label"`
+	// ExpiresAt rejects the credential after the given time.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// LastUsedAt is updated by providers on every successful login with the credential.
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Expired reports whether the credential can no longer be used at now.
+func (c Credential) Expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+// PasswordCredential reports whether the credential is a password or an API key that logs
+// in to the SFTP server.
+func (c Credential) PasswordCredential() bool {
+	return (c.CredentialType == Password || c.CredentialType == APIKey) && c.Integration == SFTP
 }
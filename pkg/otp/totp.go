@@ -0,0 +1,118 @@
+// Package otp implements time-based one-time passwords as described in RFC 6238.
+package otp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Period is the time step in seconds used to derive codes.
+	Period = 30
+	// Digits is the number of digits of a generated code.
+	Digits = 6
+	// Skew is the number of time steps before and after the current one that are still accepted
+	// to tolerate clock drift between the client and the server.
+	Skew = 1
+)
+
+var (
+	encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+	modulo   = uint32(math.Pow10(Digits))
+)
+
+// DecodeSecret decodes a base32 encoded shared secret as shown to users by authenticator apps.
+func DecodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	return encoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// Generate returns the code for the given base32 secret at time t.
+func Generate(secret string, t time.Time) (string, error) {
+	key, err := DecodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(t.Unix()/Period)), nil
+}
+
+// Validate reports whether code is valid for the given base32 secret at time t.
+func Validate(code, secret string, t time.Time) bool {
+	_, ok := match(code, secret, t)
+	return ok
+}
+
+// Verifier validates codes like Validate but refuses to accept a code twice, as recommended
+// by RFC 6238 section 5.2. It remembers the last accepted time step of every user and rejects
+// codes of that step or an earlier one. The zero value is ready to use.
+type Verifier struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+// Validate reports whether code is valid for the given base32 secret at time t and was not
+// used by the user before.
+func (v *Verifier) Validate(user, code, secret string, t time.Time) bool {
+	step, ok := match(code, secret, t)
+	if !ok {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if last, ok := v.last[user]; ok && step <= last {
+		return false
+	}
+	if v.last == nil {
+		v.last = make(map[string]int64)
+	}
+	// Steps outside of the accepted window can no longer be replayed, forget them.
+	oldest := t.Unix()/Period - Skew
+	for u, last := range v.last {
+		if last < oldest {
+			delete(v.last, u)
+		}
+	}
+	v.last[user] = step
+	return true
+}
+
+// match returns the time step code is valid for, if any.
+func match(code, secret string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+	key, err := DecodeSecret(secret)
+	if err != nil || len(key) == 0 {
+		return 0, false
+	}
+	counter := t.Unix() / Period
+	for i := -Skew; i <= Skew; i++ {
+		step := counter + int64(i)
+		expected := hotp(key, uint64(step))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// hotp computes an RFC 4226 code for the given counter.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%modulo)
+}
@@ -0,0 +1,109 @@
+package otp
+
+import (
+	"testing"
+	"time"
+)
+
+// secret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890", in base32.
+const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerate(t *testing.T) {
+	// The last six digits of the eight digit codes of RFC 6238 appendix B.
+	for _, tt := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		code, err := Generate(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("code at %d = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+	if _, err := Generate("not base32!", time.Now()); err == nil {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := Generate(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		code string
+		at   time.Time
+		want bool
+	}{
+		{"current step", code, now, true},
+		{"surrounding spaces", " " + code + " ", now, true},
+		{"previous step", code, now.Add(Period * time.Second), true},
+		{"next step", code, now.Add(-Period * time.Second), true},
+		{"outside of the skew", code, now.Add(2 * Period * time.Second), false},
+		{"wrong code", "000000", now, false},
+		{"wrong length", code[:5], now, false},
+	} {
+		if got := Validate(tt.code, secret, tt.at); got != tt.want {
+			t.Errorf("%s: Validate = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if Validate(code, "", now) {
+		t.Error("code accepted without a secret")
+	}
+}
+
+func TestVerifierRejectsReplays(t *testing.T) {
+	var v Verifier
+	now := time.Unix(1234567890, 0)
+	step := Period * time.Second
+	code := func(t *testing.T, at time.Time) string {
+		t.Helper()
+		c, err := Generate(secret, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	current := code(t, now)
+	if !v.Validate("alice", current, secret, now) {
+		t.Fatal("valid code rejected")
+	}
+	if v.Validate("alice", current, secret, now) {
+		t.Fatal("code accepted twice")
+	}
+	// Other users have their own history.
+	if !v.Validate("bob", current, secret, now) {
+		t.Fatal("code of another user rejected")
+	}
+	// A code of an earlier step, still within the skew, cannot be used after a later one.
+	if v.Validate("alice", code(t, now.Add(-step)), secret, now) {
+		t.Fatal("code older than the last accepted one accepted")
+	}
+	if !v.Validate("alice", code(t, now.Add(step)), secret, now.Add(step)) {
+		t.Fatal("code of the next step rejected")
+	}
+	if v.Validate("alice", "000000", secret, now.Add(2*step)) {
+		t.Fatal("wrong code accepted")
+	}
+	// Steps that left the window are forgotten without allowing their codes again.
+	later := now.Add(10 * step)
+	if !v.Validate("alice", code(t, later), secret, later) {
+		t.Fatal("code after a long pause rejected")
+	}
+	if _, ok := v.last["bob"]; ok {
+		t.Fatal("expired step of bob not pruned")
+	}
+	if v.Validate("bob", current, secret, later) {
+		t.Fatal("code outside of the window accepted")
+	}
+}
@@ -0,0 +1,236 @@
+package providers
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/log"
+	"github.com/oarkflow/sftp/pkg/log/oarklog"
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// ChainPolicy decides how a ChainProvider combines its providers.
+type ChainPolicy int
+
+const (
+	// FirstMatch authenticates with the first provider knowing the user. Providers reporting
+	// an unknown user are skipped; any other error, e.g. a wrong password, stops the chain.
+	FirstMatch ChainPolicy = iota
+	// MatchAll requires every provider to accept the credentials. The user is taken from
+	// the first provider.
+	MatchAll
+)
+
+// ChainLink is a named provider of a chain. The name is logged with every login.
+type ChainLink struct {
+	Name     string
+	Provider UserProvider
+}
+
+// ChainProvider composes providers, e.g. local emergency accounts, then the staff directory,
+// then a partner database. Providers must report unknown users with errs.UserNotFoundError
+// to let the next one be tried.
+type ChainProvider struct {
+	links  []ChainLink
+	policy ChainPolicy
+	logger log.Logger
+}
+
+func NewChainProvider(links []ChainLink, opts ...func(*ChainProvider)) *ChainProvider {
+	p := &ChainProvider{links: links, policy: FirstMatch}
+	for _, o := range opts {
+		o(p)
+	}
+	if p.logger == nil {
+		p.logger = oarklog.Default()
+	}
+	return p
+}
+
+func WithChainPolicy(val ChainPolicy) func(*ChainProvider) {
+	return func(o *ChainProvider) {
+		o.policy = val
+	}
+}
+
+func WithChainLogger(val log.Logger) func(*ChainProvider) {
+	return func(o *ChainProvider) {
+		o.logger = val
+	}
+}
+
+func (p *ChainProvider) Login(username, pass string) (*fs.AuthenticationResponse, error) {
+	return p.Authenticate(fs.AuthenticationRequest{User: username, Pass: pass})
+}
+
+func (p *ChainProvider) LoginWithKey(username string, key ssh.PublicKey) (*fs.AuthenticationResponse, error) {
+	return p.Authenticate(fs.AuthenticationRequest{
+		User:      username,
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+	})
+}
+
+// Authenticate applies the policy of the chain to a password or a public key request. The
+// public key is trimmed like the server does, so every provider sees the same key.
+func (p *ChainProvider) Authenticate(r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error) {
+	r.PublicKey = strings.TrimSpace(r.PublicKey)
+	if p.policy == MatchAll {
+		return p.matchAll(r)
+	}
+	for _, link := range p.links {
+		resp, err := authenticateWith(link.Provider, r)
+		if errs.IsUserNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			p.logger.Debug("user rejected by provider", "user", r.User, "provider", link.Name, "err", err)
+			return nil, err
+		}
+		p.logger.Info("User authenticated by provider", "user", r.User, "provider", link.Name)
+		return resp, nil
+	}
+	return nil, errs.UserNotFoundError{Username: r.User}
+}
+
+func (p *ChainProvider) matchAll(r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error) {
+	if len(p.links) == 0 {
+		return nil, errs.UserNotFoundError{Username: r.User}
+	}
+	var first *fs.AuthenticationResponse
+	names := make([]string, 0, len(p.links))
+	for _, link := range p.links {
+		resp, err := authenticateWith(link.Provider, r)
+		if err != nil {
+			p.logger.Debug("user rejected by provider", "user", r.User, "provider", link.Name, "err", err)
+			return nil, err
+		}
+		if first == nil {
+			first = resp
+		}
+		names = append(names, link.Name)
+	}
+	p.logger.Info("User authenticated by provider", "user", r.User, "provider", strings.Join(names, ","))
+	return first, nil
+}
+
+// authenticateWith checks a request against a single provider.
+func authenticateWith(provider UserProvider, r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error) {
+	if auth, ok := provider.(RequestAuthenticator); ok {
+		return auth.Authenticate(r)
+	}
+	if r.PublicKey == "" {
+		return provider.Login(r.User, r.Pass)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	return LoginWithKey(provider, r.User, key)
+}
+
+// Get returns the user from the first provider knowing it.
+func (p *ChainProvider) Get(username string) (models.User, error) {
+	_, user, err := p.find(username)
+	return user, err
+}
+
+// SetPassword changes the password in the first provider knowing the user.
+func (p *ChainProvider) SetPassword(username, pass string) error {
+	link, _, err := p.find(username)
+	if err != nil {
+		return err
+	}
+	changer, ok := link.Provider.(PasswordChanger)
+	if !ok {
+		return errors.New("provider " + link.Name + " cannot change passwords")
+	}
+	return changer.SetPassword(username, pass)
+}
+
+// Create adds the user to the first provider of the chain managing its users. Create, List,
+// Update, Delete and AddCredential all act on that provider, the others being read-only
+// sources such as directories.
+func (p *ChainProvider) Create(user models.User) error {
+	store, err := p.store()
+	if err != nil {
+		return err
+	}
+	return store.Create(user)
+}
+
+// List returns the users of the first provider of the chain managing its users.
+func (p *ChainProvider) List(offset, limit int) ([]models.User, error) {
+	store, err := p.store()
+	if err != nil {
+		return nil, err
+	}
+	return store.List(offset, limit)
+}
+
+func (p *ChainProvider) Update(user models.User) error {
+	store, err := p.store()
+	if err != nil {
+		return err
+	}
+	return store.Update(user)
+}
+
+func (p *ChainProvider) Delete(username string) error {
+	store, err := p.store()
+	if err != nil {
+		return err
+	}
+	return store.Delete(username)
+}
+
+func (p *ChainProvider) AddCredential(username string, credential models.Credential) error {
+	store, err := p.store()
+	if err != nil {
+		return err
+	}
+	return store.AddCredential(username, credential)
+}
+
+// store returns the first provider of the chain implementing UserStore.
+func (p *ChainProvider) store() (UserStore, error) {
+	for _, link := range p.links {
+		if store, ok := link.Provider.(UserStore); ok {
+			return store, nil
+		}
+	}
+	return nil, errors.New("no provider of the chain manages users")
+}
+
+func (p *ChainProvider) find(username string) (ChainLink, models.User, error) {
+	for _, link := range p.links {
+		user, err := GetUser(link.Provider, username)
+		if errs.IsUserNotFoundError(err) {
+			continue
+		}
+		return link, user, err
+	}
+	return ChainLink{}, models.User{}, errs.UserNotFoundError{Username: username}
+}
+
+// ResolveUser merges the groups of the user with the first provider knowing it.
+func (p *ChainProvider) ResolveUser(user models.User) (models.User, error) {
+	link, _, err := p.find(user.Username)
+	if err != nil {
+		return user, err
+	}
+	if resolver, ok := link.Provider.(GroupResolver); ok {
+		return resolver.ResolveUser(user)
+	}
+	return user, nil
+}
+
+// Register adds the user to the first provider of the chain.
+func (p *ChainProvider) Register(user models.User) {
+	if len(p.links) > 0 {
+		p.links[0].Provider.Register(user)
+	}
+}
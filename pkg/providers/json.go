@@ -2,10 +2,13 @@ package providers
 
 import (
 	"crypto/rand"
+	"errors"
 	"math/big"
+	"sort"
 	"sync"
+	"time"
 	
-	"github.com/oarkflow/hash"
+	"golang.org/x/crypto/ssh"
 	
 	"github.com/oarkflow/sftp/pkg/errs"
 	"github.com/oarkflow/sftp/pkg/fs"
@@ -14,31 +17,232 @@ import (
 
 type JsonFileProvider struct {
 	users             map[string]models.User
+	groups            map[string]models.Group
 	hashAlgo          string
 	alternateHashAlgo string
 	mu                sync.RWMutex
+	// filePasswords are the passwords of the users file as last loaded by Watch.
+	filePasswords map[string]string
 }
 
+// Login checks the password of a user, then its password and API key credentials. The
+// hashing algorithm is detected from the stored hash, and legacy digests of the user password
+// are rewritten with the configured algorithm once it is a strong one.
 func (p *JsonFileProvider) Login(username, pass string) (*fs.AuthenticationResponse, error) {
+	now := time.Now()
+	p.mu.RLock()
 	user, exists := p.users[username]
-	matched, err := hash.Match(pass, user.Password, p.hashAlgo)
-	if !exists || err != nil || !matched {
+	p.mu.RUnlock()
+	if !exists {
+		// The response time must not tell whether the account exists.
+		matchDummyPassword(pass, p.hashAlgo, p.legacyHashAlgo())
+		return nil, errs.UserNotFoundError{Username: username}
+	}
+	index, algo, matched := matchUserPassword(user, pass, p.legacyHashAlgo(), now)
+	if !matched {
 		return nil, errs.InvalidCredentialsError{}
 	}
+	if err := user.CheckStatus(now); err != nil {
+		return nil, err
+	}
+	if index != userPassword {
+		user = p.credentialUsed(user, index, now)
+	} else if IsStrongHashAlgorithm(p.hashAlgo) && algo != p.hashAlgo {
+		user = p.rehash(user, pass)
+	}
+	user, _ = p.ResolveUser(user)
+	return NewAuthenticationResponse(user), nil
+}
+
+// credentialUsed records the last use of a credential, unless the credentials of the user
+// were changed in the meantime.
+func (p *JsonFileProvider) credentialUsed(user models.User, index int, now time.Time) models.User {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current, exists := p.users[user.Username]
+	if !exists || len(current.Credentials) <= index || current.Credentials[index].Credential != user.Credentials[index].Credential {
+		return user
+	}
+	current.Credentials = append([]models.Credential(nil), current.Credentials...)
+	current.Credentials[index].LastUsedAt = &now
+	p.users[user.Username] = current
+	return current
+}
+
+// legacyHashAlgo is the algorithm of stored hashes without a PHC prefix.
+func (p *JsonFileProvider) legacyHashAlgo() string {
+	return legacyHashAlgorithm(p.hashAlgo, p.alternateHashAlgo)
+}
+
+// rehash stores the password of user with the configured algorithm, unless it was changed
+// in the meantime. On failure the user keeps the previous hash.
+func (p *JsonFileProvider) rehash(user models.User, pass string) models.User {
+	encoded, err := HashPassword(pass, p.hashAlgo)
+	if err != nil {
+		return user
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if current, exists := p.users[user.Username]; exists && current.Password == user.Password {
+		current.Password = encoded
+		p.users[user.Username] = current
+		return current
+	}
+	return user
+}
+
+func (p *JsonFileProvider) LoginWithKey(username string, key ssh.PublicKey) (*fs.AuthenticationResponse, error) {
+	p.mu.RLock()
+	user, exists := p.users[username]
+	p.mu.RUnlock()
+	if !exists {
+		return nil, errs.UserNotFoundError{Username: username}
+	}
+	if !user.HasPublicKey(key) {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	if err := user.CheckStatus(time.Now()); err != nil {
+		return nil, err
+	}
+	user, _ = p.ResolveUser(user)
+	return NewAuthenticationResponse(user), nil
+}
+
+// ResolveUser merges the groups of the user into it.
+func (p *JsonFileProvider) ResolveUser(user models.User) (models.User, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return user.ResolveGroups(p.groups), nil
+}
+
+// SetGroups replaces all groups at once. Established sessions keep the settings they were
+// granted.
+func (p *JsonFileProvider) SetGroups(groups map[string]models.Group) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.groups = groups
+}
+
+// SetPassword stores a new password for the user with the configured algorithm and clears
+// its password expiry.
+func (p *JsonFileProvider) SetPassword(username, pass string) error {
+	if pass == "" {
+		return errors.New("password must not be empty")
+	}
+	encoded, err := HashPassword(pass, p.hashAlgo)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	user, exists := p.users[username]
+	if !exists {
+		return errs.UserNotFoundError{Username: username}
+	}
+	user.Password = encoded
+	user.PasswordExpiresAt = nil
+	p.users[username] = user
+	return nil
+}
+
+func (p *JsonFileProvider) Get(username string) (models.User, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	user, exists := p.users[username]
+	if !exists {
+		return models.User{}, errs.UserNotFoundError{Username: username}
+	}
+	return user, nil
+}
+
+// NewAuthenticationResponse builds a response for a user whose credentials were verified.
+func NewAuthenticationResponse(user models.User) *fs.AuthenticationResponse {
 	n, _ := rand.Int(rand.Reader, big.NewInt(9223372036854775807))
 	return &fs.AuthenticationResponse{
 		Server: "none",
 		Token:  n.String(),
 		User:   user,
-	}, nil
+	}
 }
 
+// Register creates or replaces the user.
 func (p *JsonFileProvider) Register(user models.User) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.users[user.Username] = user
 }
 
+func (p *JsonFileProvider) Create(user models.User) error {
+	if user.Username == "" {
+		return errors.New("username must not be empty")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.users[user.Username]; exists {
+		return errs.UserExistsError{Username: user.Username}
+	}
+	p.users[user.Username] = user
+	return nil
+}
+
+// List returns up to limit users ordered by username, skipping the first offset ones.
+func (p *JsonFileProvider) List(offset, limit int) ([]models.User, error) {
+	if offset < 0 || limit < 0 {
+		return nil, errors.New("offset and limit must not be negative")
+	}
+	p.mu.RLock()
+	names := make([]string, 0, len(p.users))
+	for name := range p.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if offset > len(names) {
+		offset = len(names)
+	}
+	names = names[offset:min(offset+limit, len(names))]
+	users := make([]models.User, 0, len(names))
+	for _, name := range names {
+		users = append(users, p.users[name])
+	}
+	p.mu.RUnlock()
+	return users, nil
+}
+
+func (p *JsonFileProvider) Update(user models.User) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.users[user.Username]; !exists {
+		return errs.UserNotFoundError{Username: user.Username}
+	}
+	p.users[user.Username] = user
+	return nil
+}
+
+func (p *JsonFileProvider) Delete(username string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.users[username]; !exists {
+		return errs.UserNotFoundError{Username: username}
+	}
+	delete(p.users, username)
+	return nil
+}
+
+func (p *JsonFileProvider) AddCredential(username string, credential models.Credential) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	user, exists := p.users[username]
+	if !exists {
+		return errs.UserNotFoundError{Username: username}
+	}
+	user.Credentials = append(append([]models.Credential(nil), user.Credentials...), credential)
+	p.users[username] = user
+	return nil
+}
+
+// NewJsonFileProvider creates an in-memory provider. hashAlgo is the algorithm passwords are
+// stored with; when it is argon2id or bcrypt, passwords still hashed with the legacy
+// alternateHashAlgo (sha256 by default) are rehashed on the next successful login.
 func NewJsonFileProvider(hashAlgo, alternateHashAlgo string, users ...map[string]models.User) *JsonFileProvider {
 	user := make(map[string]models.User)
 	if len(users) > 0 && users[0] != nil {
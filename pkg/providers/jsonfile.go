@@ -0,0 +1,242 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/log"
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// DefaultWatchInterval is how often Watch checks the users file when no interval is given.
+const DefaultWatchInterval = 2 * time.Second
+
+// LoadUsersFile reads a users file, a JSON object of users keyed by username, and validates
+// every entry. The username of an entry defaults to its key.
+func LoadUsersFile(path string) (map[string]models.User, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users map[string]models.User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key, user := range users {
+		if user.Username == "" {
+			user.Username = key
+			users[key] = user
+		}
+		if err := validateUser(key, user); err != nil {
+			return nil, fmt.Errorf("%s: user %q: %w", path, key, err)
+		}
+	}
+	return users, nil
+}
+
+// LoadGroupsFile reads a groups file, a JSON object of groups keyed by name, and validates
+// every entry. The name of an entry defaults to its key.
+func LoadGroupsFile(path string) (map[string]models.Group, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var groups map[string]models.Group
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for key, group := range groups {
+		if group.Name == "" {
+			group.Name = key
+			groups[key] = group
+		}
+		if err := validateGroup(key, group); err != nil {
+			return nil, fmt.Errorf("%s: group %q: %w", path, key, err)
+		}
+	}
+	return groups, nil
+}
+
+func validateUser(key string, user models.User) error {
+	if key == "" {
+		return fmt.Errorf("empty username")
+	}
+	if user.Username != key {
+		return fmt.Errorf("username %q does not match its key", user.Username)
+	}
+	for _, group := range user.Groups {
+		if group == "" {
+			return fmt.Errorf("empty group name")
+		}
+	}
+	for _, key := range user.PublicKeys {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key)); err != nil {
+			return fmt.Errorf("public key: %w", err)
+		}
+	}
+	return validateSettings(user.Filesystems, user.AllowedIPs, user.DeniedIPs, user.TwoFactor)
+}
+
+func validateGroup(key string, group models.Group) error {
+	if key == "" {
+		return fmt.Errorf("empty group name")
+	}
+	if group.Name != key {
+		return fmt.Errorf("name %q does not match its key", group.Name)
+	}
+	return validateSettings(group.Filesystems, group.AllowedIPs, group.DeniedIPs, group.TwoFactor)
+}
+
+// validateSettings checks the settings users and groups have in common.
+func validateSettings(filesystems []*models.Filesystem, allowedIPs, deniedIPs []string, twoFactor models.TwoFactorMode) error {
+	for _, filesystem := range filesystems {
+		if filesystem == nil || filesystem.Fs == "" {
+			return fmt.Errorf("filesystem without type")
+		}
+		if filesystem.Mount != "" && (!strings.HasPrefix(filesystem.Mount, "/") || path.Clean(filesystem.Mount) == "/") {
+			return fmt.Errorf("filesystem %s: mount %q is not an absolute folder", filesystem.Fs, filesystem.Mount)
+		}
+	}
+	for _, cidr := range append(append([]string(nil), allowedIPs...), deniedIPs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			return fmt.Errorf("invalid address %q", cidr)
+		}
+	}
+	switch twoFactor {
+	case models.TwoFactorNone, models.TwoFactorPassword, models.TwoFactorPublicKey, models.TwoFactorAny:
+	default:
+		return fmt.Errorf("unknown two factor mode %q", twoFactor)
+	}
+	return nil
+}
+
+// Replace swaps all users of the provider at once. Logins in progress see either the old or
+// the new users, and established sessions keep the permissions they were granted.
+func (p *JsonFileProvider) Replace(users map[string]models.User) {
+	if users == nil {
+		users = make(map[string]models.User)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.users = users
+}
+
+// Watch loads the users file and reloads it whenever its modification time or size changes,
+// until ctx is done. The first load error is returned; later ones are logged and the
+// previous users are kept. The file is the source of truth, except for what changed in
+// memory since the previous load: a password rehashed or changed in memory is kept until
+// the file changes the password of that user, and the last use of credentials is kept.
+func (p *JsonFileProvider) Watch(ctx context.Context, path string, interval time.Duration, logger log.Logger) error {
+	return watchFile(ctx, path, interval, logger, "users", func() (int, error) {
+		users, err := LoadUsersFile(path)
+		if err != nil {
+			return 0, err
+		}
+		p.reload(users)
+		return len(users), nil
+	})
+}
+
+// reload replaces the users with the ones loaded from the users file, merging in the
+// passwords and the last use of credentials written in memory since the previous load.
+func (p *JsonFileProvider) reload(users map[string]models.User) {
+	passwords := make(map[string]string, len(users))
+	for username, user := range users {
+		passwords[username] = user.Password
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for username, user := range users {
+		current, exists := p.users[username]
+		if !exists {
+			continue
+		}
+		if previous, loaded := p.filePasswords[username]; loaded && previous == user.Password {
+			user.Password = current.Password
+			user.PasswordExpiresAt = current.PasswordExpiresAt
+		}
+		user.Credentials = mergeLastUse(user.Credentials, current.Credentials)
+		users[username] = user
+	}
+	p.users = users
+	p.filePasswords = passwords
+}
+
+// mergeLastUse copies the last use of the current credentials to the loaded ones storing the
+// same secret, when it is more recent.
+func mergeLastUse(loaded, current []models.Credential) []models.Credential {
+	for i := range loaded {
+		for _, cred := range current {
+			if cred.Credential != loaded[i].Credential || cred.LastUsedAt == nil {
+				continue
+			}
+			if loaded[i].LastUsedAt == nil || cred.LastUsedAt.After(*loaded[i].LastUsedAt) {
+				loaded[i].LastUsedAt = cred.LastUsedAt
+			}
+			break
+		}
+	}
+	return loaded
+}
+
+// WatchGroups loads the groups file and reloads it like Watch does for the users file.
+func (p *JsonFileProvider) WatchGroups(ctx context.Context, path string, interval time.Duration, logger log.Logger) error {
+	return watchFile(ctx, path, interval, logger, "groups", func() (int, error) {
+		groups, err := LoadGroupsFile(path)
+		if err != nil {
+			return 0, err
+		}
+		p.SetGroups(groups)
+		return len(groups), nil
+	})
+}
+
+// watchFile runs load once, then again whenever the file at path changes. load returns the
+// number of entries it applied.
+func watchFile(ctx context.Context, path string, interval time.Duration, logger log.Logger, kind string, load func() (int, error)) error {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if _, err := load(); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := os.Stat(path)
+			if err != nil {
+				logger.Error("failed to stat "+kind+" file", "file", path, "err", err)
+				continue
+			}
+			if current.ModTime().Equal(stat.ModTime()) && current.Size() == stat.Size() {
+				continue
+			}
+			stat = current
+			n, err := load()
+			if err != nil {
+				logger.Error("failed to reload "+kind+" file, keeping previous "+kind, "file", path, "err", err)
+				continue
+			}
+			logger.Info("Reloaded "+kind+" file", "file", path, kind, n)
+		}
+	}()
+	return nil
+}
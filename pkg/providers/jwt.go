@@ -0,0 +1,491 @@
+package providers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// JWTConfig configures how access tokens are verified and mapped to users.
+type JWTConfig struct {
+	// Issuer and Audience must match the iss and aud claims of every token.
+	Issuer   string
+	Audience string
+	// JWKSFile or JWKSURL hold the signing keys of the issuer as a JSON Web Key Set.
+	JWKSFile string
+	JWKSURL  string
+	// RefreshInterval is how often the key set is reloaded, 5 minutes by default. Tokens
+	// signed with an unknown key also trigger a reload, at most once per MinRefreshInterval.
+	RefreshInterval    time.Duration
+	MinRefreshInterval time.Duration
+	// Leeway tolerates clock skew when checking exp and nbf, one minute by default.
+	Leeway time.Duration
+	// UsernameClaim must match the SSH username. Defaults to preferred_username, falling back
+	// to sub when the token has no such claim.
+	UsernameClaim string
+	// PermissionsClaim holds the permissions of the user as an array or a space separated
+	// string, like scope. Permissions applies when the token has no such claim.
+	PermissionsClaim string
+	Permissions      []string
+	// FilesystemsClaim, when set, holds the filesystems of the user as a JSON array.
+	// Otherwise Filesystems applies; their string parameters are text/template templates
+	// executed with a JWTClaims, e.g. "/srv/sftp/{{.Username}}" or "{{.Claims.tenant}}".
+	FilesystemsClaim  string
+	Filesystems       []*models.Filesystem
+	DefaultFilesystem string
+	// Client fetches JWKSURL, with a 10 second timeout by default.
+	Client *http.Client
+}
+
+// JWTClaims is the data the filesystem templates are executed with.
+type JWTClaims struct {
+	Username string
+	Claims   map[string]any
+}
+
+// Validate rejects usernames that cannot be used as a folder name, see models.ValidateUsername.
+func (c JWTClaims) Validate() error {
+	return models.ValidateUsername(c.Username)
+}
+
+// JWTProvider authenticates clients sending a signed JWT access token as their password,
+// e.g. CI jobs holding short-lived tokens from an OAuth2 / OIDC identity provider. RSA,
+// RSA-PSS, ECDSA and Ed25519 signatures are supported. Passwords that are not a JWT are
+// reported as unknown users, so the provider can precede others in a ChainProvider.
+type JWTProvider struct {
+	config      JWTConfig
+	keys        map[string]jsonWebKey
+	loadedAt    time.Time
+	refreshedAt time.Time
+	// refreshing is the key set load in progress, shared by concurrent verifications.
+	refreshing *jwksRefresh
+	mu         sync.Mutex
+}
+
+type jwksRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	key crypto.PublicKey
+}
+
+// NewJWTProvider loads the key set and fails when it cannot be read.
+func NewJWTProvider(config JWTConfig) (*JWTProvider, error) {
+	if config.JWKSFile == "" && config.JWKSURL == "" {
+		return nil, errors.New("jwt: a JWKS file or url is required")
+	}
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("jwt: issuer and audience are required")
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = 5 * time.Minute
+	}
+	if config.MinRefreshInterval <= 0 {
+		config.MinRefreshInterval = 30 * time.Second
+	}
+	if config.Leeway <= 0 {
+		config.Leeway = time.Minute
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.PermissionsClaim == "" {
+		config.PermissionsClaim = "permissions"
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	p := &JWTProvider{config: config}
+	if err := p.refresh(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Login verifies the token sent as password and builds the user from its claims.
+func (p *JWTProvider) Login(username, token string) (*fs.AuthenticationResponse, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errs.UserNotFoundError{Username: username}
+	}
+	claims, err := p.verify(parts)
+	if err != nil {
+		return nil, err
+	}
+	subject := claimString(claims, p.config.UsernameClaim)
+	if subject == "" {
+		subject = claimString(claims, "sub")
+	}
+	if subject == "" || subject != username {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	user, err := p.buildUser(username, claims)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuthenticationResponse(user), nil
+}
+
+// Register is a no-op: users are managed by the identity provider.
+func (p *JWTProvider) Register(models.User) {}
+
+// verify checks the signature and the registered claims of a token split in its three parts.
+func (p *JWTProvider) verify(parts []string) (map[string]any, error) {
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.Alg != "" && key.Alg != header.Alg {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	if err := verifySignature(header.Alg, key.key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	now := time.Now()
+	if claimString(claims, "iss") != p.config.Issuer || !hasAudience(claims["aud"], p.config.Audience) {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	exp, ok := claimTime(claims, "exp")
+	if !ok || !now.Before(exp.Add(p.config.Leeway)) {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Add(p.config.Leeway).Before(nbf) {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	return claims, nil
+}
+
+func (p *JWTProvider) buildUser(username string, claims map[string]any) (models.User, error) {
+	user := models.User{
+		Username:          username,
+		Permissions:       p.config.Permissions,
+		DefaultFilesystem: p.config.DefaultFilesystem,
+	}
+	if permissions, ok := claimStrings(claims, p.config.PermissionsClaim); ok {
+		user.Permissions = permissions
+	}
+	if p.config.FilesystemsClaim != "" {
+		if raw, exists := claims[p.config.FilesystemsClaim]; exists {
+			data, err := json.Marshal(raw)
+			if err != nil {
+				return models.User{}, err
+			}
+			if err := json.Unmarshal(data, &user.Filesystems); err != nil {
+				return models.User{}, fmt.Errorf("jwt: claim %s: %w", p.config.FilesystemsClaim, err)
+			}
+			return user, nil
+		}
+	}
+	data := JWTClaims{Username: username, Claims: claims}
+	for _, filesystem := range p.config.Filesystems {
+		expanded, err := filesystem.Expand(data)
+		if err != nil {
+			return models.User{}, err
+		}
+		user.Filesystems = append(user.Filesystems, expanded)
+	}
+	return user, nil
+}
+
+// key returns the key identified by kid. Unknown keys reload the key set, as the issuer may
+// have rotated its keys. Tokens without kid are accepted when the set has a single key.
+func (p *JWTProvider) key(kid string) (jsonWebKey, error) {
+	p.mu.Lock()
+	key, exists := p.lookup(kid)
+	stale := time.Since(p.loadedAt) > p.config.RefreshInterval
+	canRefresh := time.Since(p.refreshedAt) > p.config.MinRefreshInterval
+	p.mu.Unlock()
+	if (!exists && canRefresh) || stale {
+		if err := p.refresh(); err != nil && !exists {
+			return jsonWebKey{}, err
+		}
+		p.mu.Lock()
+		key, exists = p.lookup(kid)
+		p.mu.Unlock()
+	}
+	if !exists {
+		return jsonWebKey{}, errs.InvalidCredentialsError{}
+	}
+	return key, nil
+}
+
+func (p *JWTProvider) lookup(kid string) (jsonWebKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, exists := p.keys[kid]
+	return key, exists
+}
+
+// refresh loads the key set. On failure the previous keys are kept. Concurrent calls wait
+// for the load in progress instead of fetching the key set again.
+func (p *JWTProvider) refresh() error {
+	p.mu.Lock()
+	if call := p.refreshing; call != nil {
+		p.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &jwksRefresh{done: make(chan struct{})}
+	p.refreshing = call
+	p.refreshedAt = time.Now()
+	p.mu.Unlock()
+	call.err = p.load()
+	p.mu.Lock()
+	p.refreshing = nil
+	p.mu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+func (p *JWTProvider) load() error {
+	data, err := p.readKeySet()
+	if err != nil {
+		return fmt.Errorf("jwt: jwks: %w", err)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("jwt: jwks: %w", err)
+	}
+	keys := make(map[string]jsonWebKey, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if key.key, err = key.publicKey(); err != nil {
+			return fmt.Errorf("jwt: jwks key %q: %w", key.Kid, err)
+		}
+		keys[key.Kid] = key
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys = keys
+	p.loadedAt = time.Now()
+	return nil
+}
+
+func (p *JWTProvider) readKeySet() ([]byte, error) {
+	if p.config.JWKSFile != "" {
+		return os.ReadFile(p.config.JWKSFile)
+	}
+	res, err := p.config.Client.Get(p.config.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// ecdsaCurveBits is the curve size each ECDSA algorithm must be used with.
+var ecdsaCurveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// verifySignature checks a JWS signature. Unsigned and HMAC tokens are rejected, as the
+// key set only holds public keys.
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if alg[0] != 'R' {
+			return errors.New("key does not match the algorithm")
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if ecdsaCurveBits[alg] != pub.Curve.Params().BitSize || len(signature) != 2*size {
+			return errors.New("key does not match the algorithm")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("key does not match the algorithm")
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func claimString(claims map[string]any, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+func claimTime(claims map[string]any, name string) (time.Time, bool) {
+	n, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(n), 0), true
+}
+
+// claimStrings reads a claim holding an array of strings or a space separated string.
+func claimStrings(claims map[string]any, name string) ([]string, bool) {
+	switch val := claims[name].(type) {
+	case string:
+		return strings.Fields(val), true
+	case []any:
+		values := make([]string, 0, len(val))
+		for _, v := range val {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values, true
+	}
+	return nil, false
+}
+
+func hasAudience(aud any, audience string) bool {
+	switch val := aud.(type) {
+	case string:
+		return val == audience
+	case []any:
+		for _, v := range val {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
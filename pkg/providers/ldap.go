@@ -0,0 +1,375 @@
+package providers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// DefaultLDAPCacheTTL is how long a successful bind is remembered when LDAPConfig.CacheTTL
+// is zero.
+const DefaultLDAPCacheTTL = time.Minute
+
+// adAccountDisable is the ACCOUNTDISABLE flag of the Active Directory userAccountControl
+// attribute.
+const adAccountDisable = 0x2
+
+// LDAPConn is the part of an LDAP connection used by LDAPProvider. It is implemented by
+// *ldap.Conn and can be replaced by an in-process stand-in through LDAPConfig.Dialer.
+type LDAPConn interface {
+	Bind(username, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPDialer opens a connection to the directory.
+type LDAPDialer func() (LDAPConn, error)
+
+// LDAPGroup maps the members of a directory group to permissions and filesystems. String
+// parameters of the filesystems are text/template templates executed with an LDAPEntry,
+// e.g. "/srv/sftp/{{.Username}}" or "{{.Attributes.homeDirectory}}".
+type LDAPGroup struct {
+	// Group is the DN or the common name of the group.
+	Group             string               `json:"group"`
+	Permissions       []string             `json:"permissions"`
+	Filesystems       []*models.Filesystem `json:"filesystems"`
+	DefaultFilesystem string               `json:"default_filesystem"`
+	MaxSessions       int                  `json:"max_sessions"`
+}
+
+// LDAPEntry is the data the filesystem templates are executed with.
+type LDAPEntry struct {
+	Username string
+	DN       string
+	// Attributes holds the first value of every attribute of the user entry.
+	Attributes map[string]string
+	Groups     []string
+}
+
+// Validate rejects usernames that cannot be used as a folder name, see models.ValidateUsername.
+func (e LDAPEntry) Validate() error {
+	return models.ValidateUsername(e.Username)
+}
+
+type LDAPConfig struct {
+	// URL of the directory, e.g. ldaps://ldap.example.com:636.
+	URL       string
+	TLSConfig *tls.Config
+	// StartTLS upgrades a plain ldap:// connection before binding.
+	StartTLS bool
+	// BindDN and BindPassword are the service account used to search users. The search is
+	// anonymous when BindDN is empty.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the user entry, %s being replaced by the escaped username. Defaults
+	// to (uid=%s); Active Directory uses (sAMAccountName=%s).
+	UserFilter string
+	// UsernameAttribute defaults to uid.
+	UsernameAttribute string
+	// GroupAttribute lists the group DNs of a user entry and defaults to memberOf.
+	GroupAttribute string
+	// PublicKeyAttribute holds authorized keys of the user and defaults to sshPublicKey.
+	PublicKeyAttribute string
+	// Permissions and Filesystems are granted to every user, before the groups.
+	Permissions []string
+	Filesystems []*models.Filesystem
+	// Groups are applied in order; the first group setting the default filesystem or the
+	// session limit wins. Users belonging to none of the groups are rejected when
+	// RequireGroup is set.
+	Groups       []LDAPGroup
+	RequireGroup bool
+	// CacheTTL is how long a successful bind is remembered, DefaultLDAPCacheTTL when zero.
+	// A negative value disables the cache.
+	CacheTTL time.Duration
+	// Dialer replaces the connection to URL, e.g. with an in-process directory in tests.
+	Dialer LDAPDialer
+}
+
+type ldapBind struct {
+	digest    [sha256.Size]byte
+	user      models.User
+	expiresAt time.Time
+}
+
+// LDAPProvider authenticates users by binding against an LDAP or Active Directory server.
+// The user is searched with the service account, then its password is verified by binding
+// as the user entry. The models.User is built from the directory attributes and the group
+// mappings of the configuration.
+type LDAPProvider struct {
+	config LDAPConfig
+	cache  map[string]ldapBind
+	mu     sync.Mutex
+}
+
+func NewLDAPProvider(config LDAPConfig) *LDAPProvider {
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.PublicKeyAttribute == "" {
+		config.PublicKeyAttribute = "sshPublicKey"
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = DefaultLDAPCacheTTL
+	}
+	if config.Dialer == nil {
+		config.Dialer = config.dial
+	}
+	return &LDAPProvider{config: config, cache: make(map[string]ldapBind)}
+}
+
+func (c LDAPConfig) dial() (LDAPConn, error) {
+	conn, err := ldap.DialURL(c.URL, ldap.DialWithTLSConfig(c.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	if c.StartTLS {
+		if err := conn.StartTLS(c.TLSConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Login binds as the user with pass. Successful binds are cached for CacheTTL so that
+// clients opening several connections do not hit the directory each time.
+func (p *LDAPProvider) Login(username, pass string) (*fs.AuthenticationResponse, error) {
+	// An empty password would be an unauthenticated bind, which most servers accept.
+	if username == "" || pass == "" {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	digest := sha256.Sum256([]byte(username + "\x00" + pass))
+	if user, ok := p.cached(username, digest); ok {
+		return NewAuthenticationResponse(user), nil
+	}
+	var user models.User
+	err := p.withConn(func(conn LDAPConn) error {
+		entry, err := p.search(conn, username)
+		if err != nil {
+			return err
+		}
+		if err := conn.Bind(entry.DN, pass); err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+				return errs.InvalidCredentialsError{}
+			}
+			return err
+		}
+		user, err = p.buildUser(username, entry)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := user.CheckStatus(time.Now()); err != nil {
+		return nil, err
+	}
+	p.store(username, digest, user)
+	return NewAuthenticationResponse(user), nil
+}
+
+// LoginWithKey checks key against the public key attribute of the user entry.
+func (p *LDAPProvider) LoginWithKey(username string, key ssh.PublicKey) (*fs.AuthenticationResponse, error) {
+	user, err := p.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	if !user.HasPublicKey(key) {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	if err := user.CheckStatus(time.Now()); err != nil {
+		return nil, err
+	}
+	return NewAuthenticationResponse(user), nil
+}
+
+func (p *LDAPProvider) Get(username string) (models.User, error) {
+	var user models.User
+	err := p.withConn(func(conn LDAPConn) error {
+		entry, err := p.search(conn, username)
+		if err != nil {
+			return err
+		}
+		user, err = p.buildUser(username, entry)
+		return err
+	})
+	return user, err
+}
+
+// Register is a no-op: users are managed in the directory.
+func (p *LDAPProvider) Register(models.User) {}
+
+// Purge forgets every cached bind, e.g. after a password was reset in the directory.
+func (p *LDAPProvider) Purge() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.cache)
+}
+
+func (p *LDAPProvider) cached(username string, digest [sha256.Size]byte) (models.User, bool) {
+	if p.config.CacheTTL < 0 {
+		return models.User{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	bind, exists := p.cache[username]
+	if !exists {
+		return models.User{}, false
+	}
+	if time.Now().After(bind.expiresAt) {
+		delete(p.cache, username)
+		return models.User{}, false
+	}
+	if subtle.ConstantTimeCompare(bind.digest[:], digest[:]) != 1 {
+		return models.User{}, false
+	}
+	return bind.user, true
+}
+
+func (p *LDAPProvider) store(username string, digest [sha256.Size]byte, user models.User) {
+	if p.config.CacheTTL < 0 {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, bind := range p.cache {
+		if now.After(bind.expiresAt) {
+			delete(p.cache, name)
+		}
+	}
+	p.cache[username] = ldapBind{digest: digest, user: user, expiresAt: now.Add(p.config.CacheTTL)}
+}
+
+// withConn dials the directory, binds with the service account when configured and runs fn.
+func (p *LDAPProvider) withConn(fn func(conn LDAPConn) error) error {
+	conn, err := p.config.Dialer()
+	if err != nil {
+		return fmt.Errorf("ldap: %w", err)
+	}
+	defer conn.Close()
+	if p.config.BindDN != "" {
+		if err := conn.Bind(p.config.BindDN, p.config.BindPassword); err != nil {
+			return fmt.Errorf("ldap: service bind: %w", err)
+		}
+	}
+	return fn(conn)
+}
+
+// search returns the single entry matching the user filter. An ambiguous user is reported as
+// invalid credentials.
+func (p *LDAPProvider) search(conn LDAPConn, username string) (*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(
+		p.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(p.config.UserFilter, ldap.EscapeFilter(username)),
+		nil, nil,
+	)
+	result, err := conn.Search(request)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, errs.UserNotFoundError{Username: username}
+		}
+		return nil, fmt.Errorf("ldap: search: %w", err)
+	}
+	if len(result.Entries) == 0 {
+		return nil, errs.UserNotFoundError{Username: username}
+	}
+	if len(result.Entries) > 1 {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	return result.Entries[0], nil
+}
+
+// buildUser maps a directory entry to a user. Permissions of the configuration and of every
+// matching group are merged; filesystems are appended in the same order.
+func (p *LDAPProvider) buildUser(username string, entry *ldap.Entry) (models.User, error) {
+	data := LDAPEntry{
+		Username:   username,
+		DN:         entry.DN,
+		Attributes: make(map[string]string, len(entry.Attributes)),
+		Groups:     entry.GetEqualFoldAttributeValues(p.config.GroupAttribute),
+	}
+	for _, attr := range entry.Attributes {
+		if len(attr.Values) > 0 {
+			data.Attributes[attr.Name] = attr.Values[0]
+		}
+	}
+	if name := entry.GetEqualFoldAttributeValue(p.config.UsernameAttribute); name != "" {
+		data.Username = name
+	}
+	user := models.User{
+		Username:   data.Username,
+		PublicKeys: entry.GetEqualFoldAttributeValues(p.config.PublicKeyAttribute),
+	}
+	if uac, err := strconv.Atoi(entry.GetEqualFoldAttributeValue("userAccountControl")); err == nil {
+		user.Disabled = uac&adAccountDisable != 0
+	}
+	permissions := append([]string(nil), p.config.Permissions...)
+	filesystems := append([]*models.Filesystem(nil), p.config.Filesystems...)
+	matched := false
+	for _, group := range p.config.Groups {
+		if !memberOf(data.Groups, group.Group) {
+			continue
+		}
+		matched = true
+		user.Groups = append(user.Groups, group.Group)
+		permissions = append(permissions, group.Permissions...)
+		filesystems = append(filesystems, group.Filesystems...)
+		if user.DefaultFilesystem == "" {
+			user.DefaultFilesystem = group.DefaultFilesystem
+		}
+		if user.MaxSessions == 0 {
+			user.MaxSessions = group.MaxSessions
+		}
+	}
+	if p.config.RequireGroup && !matched {
+		return models.User{}, errs.InvalidCredentialsError{}
+	}
+	user.Permissions = models.Unique(permissions)
+	for _, filesystem := range filesystems {
+		expanded, err := filesystem.Expand(data)
+		if err != nil {
+			return models.User{}, err
+		}
+		user.Filesystems = append(user.Filesystems, expanded)
+	}
+	return user, nil
+}
+
+// memberOf reports whether group, a DN or a common name, is one of the group DNs.
+func memberOf(groups []string, group string) bool {
+	for _, dn := range groups {
+		if strings.EqualFold(dn, group) {
+			return true
+		}
+		parsed, err := ldap.ParseDN(dn)
+		if err != nil || len(parsed.RDNs) == 0 {
+			continue
+		}
+		for _, attr := range parsed.RDNs[0].Attributes {
+			if strings.EqualFold(attr.Type, "cn") && strings.EqualFold(attr.Value, group) {
+				return true
+			}
+		}
+	}
+	return false
+}
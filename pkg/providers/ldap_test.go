@@ -0,0 +1,237 @@
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// testDirectory is an in-process stand-in for an LDAP server, dialed through LDAPConfig.Dialer.
+type testDirectory struct {
+	mu        sync.Mutex
+	passwords map[string]string
+	entries   []*ldap.Entry
+	dials     int
+	binds     []string
+}
+
+func (d *testDirectory) add(dn, password string, attributes map[string][]string) {
+	d.passwords[dn] = password
+	d.entries = append(d.entries, ldap.NewEntry(dn, attributes))
+}
+
+func (d *testDirectory) dial() (LDAPConn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	return testLDAPConn{d}, nil
+}
+
+type testLDAPConn struct {
+	directory *testDirectory
+}
+
+func (c testLDAPConn) Bind(username, password string) error {
+	d := c.directory
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.binds = append(d.binds, username)
+	if expected, ok := d.passwords[username]; !ok || expected != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+// Search only understands the (uid=%s) filter of the tests.
+func (c testLDAPConn) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d := c.directory
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result := &ldap.SearchResult{}
+	for _, entry := range d.entries {
+		if !strings.HasSuffix(entry.DN, request.BaseDN) {
+			continue
+		}
+		if request.Filter == fmt.Sprintf("(uid=%s)", ldap.EscapeFilter(entry.GetAttributeValue("uid"))) {
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	return result, nil
+}
+
+func (c testLDAPConn) Close() error {
+	return nil
+}
+
+func newTestDirectory(t *testing.T) (*testDirectory, ssh.PublicKey) {
+	key := newTestKey(t)
+	d := &testDirectory{passwords: map[string]string{"cn=service,dc=example,dc=com": "service"}}
+	d.add("uid=alice,ou=people,dc=example,dc=com", "secret", map[string][]string{
+		"uid":           {"alice"},
+		"homeDirectory": {"/home/alice"},
+		"memberOf":      {"cn=staff,ou=groups,dc=example,dc=com", "cn=admins,ou=groups,dc=example,dc=com"},
+		"sshPublicKey":  {strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))},
+	})
+	d.add("uid=bob,ou=people,dc=example,dc=com", "secret", map[string][]string{
+		"uid": {"bob"},
+	})
+	d.add("uid=carol,ou=people,dc=example,dc=com", "secret", map[string][]string{
+		"uid":                {"carol"},
+		"memberOf":           {"cn=staff,ou=groups,dc=example,dc=com"},
+		"userAccountControl": {"514"},
+	})
+	return d, key
+}
+
+func newTestLDAPProvider(d *testDirectory, config LDAPConfig) *LDAPProvider {
+	config.BindDN = "cn=service,dc=example,dc=com"
+	config.BindPassword = "service"
+	config.BaseDN = "ou=people,dc=example,dc=com"
+	config.Dialer = d.dial
+	return NewLDAPProvider(config)
+}
+
+func TestLDAPProviderLogin(t *testing.T) {
+	d, key := newTestDirectory(t)
+	p := newTestLDAPProvider(d, LDAPConfig{
+		Permissions: []string{"read"},
+		Filesystems: []*models.Filesystem{
+			{Fs: "os", Params: map[string]any{"base_path": "{{.Attributes.homeDirectory}}"}},
+		},
+		Groups: []LDAPGroup{
+			{Group: "staff", Permissions: []string{"read", "create"}, MaxSessions: 2},
+			{
+				Group:             "cn=admins,ou=groups,dc=example,dc=com",
+				Permissions:       []string{"delete"},
+				DefaultFilesystem: "s3",
+				MaxSessions:       5,
+				Filesystems: []*models.Filesystem{
+					{Fs: "s3", Params: map[string]any{"prefix": "users/{{.Username}}"}},
+				},
+			},
+			{Group: "nobody", Permissions: []string{"update"}},
+		},
+	})
+	resp, err := p.Login("alice", "secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	user := resp.User
+	if strings.Join(user.Permissions, ",") != "read,create,delete" {
+		t.Fatalf("permissions = %v", user.Permissions)
+	}
+	if strings.Join(user.Groups, ",") != "staff,cn=admins,ou=groups,dc=example,dc=com" {
+		t.Fatalf("groups = %v", user.Groups)
+	}
+	if user.MaxSessions != 2 || user.DefaultFilesystem != "s3" {
+		t.Fatalf("the first group setting a value must win: %+v", user)
+	}
+	if len(user.Filesystems) != 2 {
+		t.Fatalf("filesystems = %+v", user.Filesystems)
+	}
+	if user.Filesystems[0].Params["base_path"] != "/home/alice" || user.Filesystems[1].Params["prefix"] != "users/alice" {
+		t.Fatalf("filesystem templates not expanded: %v, %v", user.Filesystems[0].Params, user.Filesystems[1].Params)
+	}
+	if d.binds[0] != "cn=service,dc=example,dc=com" || d.binds[1] != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Fatalf("binds = %v, want the service account then the user", d.binds)
+	}
+
+	if _, err := p.Login("alice", "wrong"); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login with a wrong password: got %v, want InvalidCredentialsError", err)
+	}
+	if _, err := p.Login("alice", ""); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login with an empty password: got %v, want InvalidCredentialsError", err)
+	}
+	if _, err := p.Login("dave", "secret"); !errs.IsUserNotFoundError(err) {
+		t.Fatalf("login of an unknown user: got %v, want UserNotFoundError", err)
+	}
+	if _, err := p.Login("carol", "secret"); err == nil {
+		t.Fatal("login of a disabled account succeeded")
+	}
+
+	if _, err := p.LoginWithKey("alice", key); err != nil {
+		t.Fatalf("login with key: %v", err)
+	}
+	if _, err := p.LoginWithKey("alice", newTestKey(t)); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login with an unknown key: got %v, want InvalidCredentialsError", err)
+	}
+}
+
+func TestLDAPProviderRequireGroup(t *testing.T) {
+	d, _ := newTestDirectory(t)
+	p := newTestLDAPProvider(d, LDAPConfig{
+		Groups:       []LDAPGroup{{Group: "staff", Permissions: []string{"read"}}},
+		RequireGroup: true,
+	})
+	if _, err := p.Login("alice", "secret"); err != nil {
+		t.Fatalf("login of a member: %v", err)
+	}
+	if _, err := p.Login("bob", "secret"); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login of a user outside of the groups: got %v, want InvalidCredentialsError", err)
+	}
+}
+
+func TestLDAPProviderCache(t *testing.T) {
+	d, _ := newTestDirectory(t)
+	p := newTestLDAPProvider(d, LDAPConfig{})
+	for i := 0; i < 3; i++ {
+		if _, err := p.Login("alice", "secret"); err != nil {
+			t.Fatalf("login %d: %v", i, err)
+		}
+	}
+	if d.dials != 1 {
+		t.Fatalf("%d dials for repeated logins, want 1", d.dials)
+	}
+	// A cached bind never vouches for another password.
+	if _, err := p.Login("alice", "wrong"); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login with a wrong password: got %v, want InvalidCredentialsError", err)
+	}
+	if d.dials != 2 {
+		t.Fatalf("%d dials, a wrong password must reach the directory", d.dials)
+	}
+	p.Purge()
+	if _, err := p.Login("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if d.dials != 3 {
+		t.Fatalf("%d dials, Purge must forget cached binds", d.dials)
+	}
+
+	d, _ = newTestDirectory(t)
+	p = newTestLDAPProvider(d, LDAPConfig{CacheTTL: -1})
+	for i := 0; i < 2; i++ {
+		if _, err := p.Login("alice", "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.dials != 2 {
+		t.Fatalf("%d dials with the cache disabled, want 2", d.dials)
+	}
+}
+
+func TestLDAPProviderUnsafeUsername(t *testing.T) {
+	d, _ := newTestDirectory(t)
+	d.add("uid=alice/private,ou=people,dc=example,dc=com", "secret", map[string][]string{
+		"uid": {"alice/private"},
+	})
+	p := newTestLDAPProvider(d, LDAPConfig{
+		Filesystems: []*models.Filesystem{
+			{Fs: "os", Params: map[string]any{"base_path": "/srv/sftp/{{.Username}}"}},
+		},
+	})
+	if _, err := p.Login("alice", "secret"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	// The home of alice/private would be a folder of the home of alice.
+	if _, err := p.Login("alice/private", "secret"); err == nil || !strings.Contains(err.Error(), "path separator") {
+		t.Fatalf("got %v, want the username rejected", err)
+	}
+}
@@ -0,0 +1,103 @@
+package providers
+
+import (
+	"strings"
+	"sync"
+	"time"
+	
+	"github.com/oarkflow/hash"
+	
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// Strong password hashing algorithms, stored in PHC string format.
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// HashAlgorithm detects the algorithm of an encoded password from its PHC prefix. Hashes
+// without a known prefix are legacy digests of the given algorithm.
+func HashAlgorithm(encoded, legacy string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return Argon2id
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return Bcrypt
+	}
+	return legacy
+}
+
+// IsStrongHashAlgorithm reports whether algo is a salted, slow password hashing algorithm.
+func IsStrongHashAlgorithm(algo string) bool {
+	return algo == Argon2id || algo == Bcrypt
+}
+
+// MatchPassword checks pass against an encoded password, detecting its algorithm. It returns
+// the detected algorithm so callers can decide to rehash legacy passwords.
+func MatchPassword(pass, encoded, legacy string) (bool, string) {
+	algo := HashAlgorithm(encoded, legacy)
+	if encoded == "" {
+		return false, algo
+	}
+	matched, err := hash.Match(pass, encoded, algo)
+	return err == nil && matched, algo
+}
+
+// dummyHashes caches per algorithm the hash unknown users are compared against.
+var dummyHashes sync.Map
+
+// matchDummyPassword compares pass against a hash made with algo and drops the result, so
+// that the login of an unknown user takes as long as a failed login of an existing one.
+func matchDummyPassword(pass, algo, legacy string) {
+	encoded, ok := dummyHashes.Load(algo)
+	if !ok {
+		h, err := HashPassword("unknown user", algo)
+		if err != nil {
+			return
+		}
+		encoded, _ = dummyHashes.LoadOrStore(algo, h)
+	}
+	MatchPassword(pass, encoded.(string), legacy)
+}
+
+// userPassword is the credential index matchUserPassword reports for User.Password.
+const userPassword = -1
+
+// matchUserPassword checks pass against the password of the user, then against every
+// unexpired password and API key credential of the SFTP integration. Credentials are hashed
+// like the password. It returns the index of the matching credential, or userPassword.
+func matchUserPassword(user models.User, pass, legacy string, now time.Time) (int, string, bool) {
+	if user.Password != "" {
+		if matched, algo := MatchPassword(pass, user.Password, legacy); matched {
+			return userPassword, algo, true
+		}
+	}
+	for i, cred := range user.Credentials {
+		if !cred.PasswordCredential() || cred.Expired(now) || cred.Credential == "" {
+			continue
+		}
+		if matched, algo := MatchPassword(pass, cred.Credential, legacy); matched {
+			return i, algo, true
+		}
+	}
+	return 0, "", false
+}
+
+// HashPassword encodes pass with the given algorithm.
+func HashPassword(pass, algo string) (string, error) {
+	return hash.Make(pass, algo)
+}
+
+// legacyHashAlgorithm returns the algorithm of stored hashes without a PHC prefix: the
+// alternate algorithm when set, the configured one when it is not a strong algorithm, and
+// sha256 otherwise.
+func legacyHashAlgorithm(hashAlgo, alternateHashAlgo string) string {
+	if alternateHashAlgo != "" {
+		return alternateHashAlgo
+	}
+	if !IsStrongHashAlgorithm(hashAlgo) {
+		return hashAlgo
+	}
+	return "sha256"
+}
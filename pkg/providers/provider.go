@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"golang.org/x/crypto/ssh"
+	
+	"github.com/oarkflow/sftp/pkg/errs"
 	"github.com/oarkflow/sftp/pkg/fs"
 	"github.com/oarkflow/sftp/pkg/models"
 )
@@ -13,3 +16,94 @@ type UserProvider interface {
 	Login(user, pass string) (*fs.AuthenticationResponse, error)
 	Register(user models.User)
 }
+
+// UserGetter is implemented by providers able to look a user up without any credential. It
+// is used once the client was authenticated by other means, e.g. a certificate signed by a
+// trusted authority.
+type UserGetter interface {
+	Get(user string) (models.User, error)
+}
+
+// GetUser returns user when the provider is a UserGetter. Other providers cannot look users
+// up and report errs.UserNotFoundError.
+func GetUser(provider UserProvider, user string) (models.User, error) {
+	getter, ok := provider.(UserGetter)
+	if !ok {
+		return models.User{}, errs.UserNotFoundError{Username: user}
+	}
+	return getter.Get(user)
+}
+
+// KeyAuthenticator is implemented by providers storing the public keys of their users.
+// Public key logins are rejected for users of other providers.
+type KeyAuthenticator interface {
+	LoginWithKey(user string, key ssh.PublicKey) (*fs.AuthenticationResponse, error)
+}
+
+// LoginWithKey authenticates user with key when the provider is a KeyAuthenticator. Other
+// providers know no user by key and report errs.UserNotFoundError.
+func LoginWithKey(provider UserProvider, user string, key ssh.PublicKey) (*fs.AuthenticationResponse, error) {
+	auth, ok := provider.(KeyAuthenticator)
+	if !ok {
+		return nil, errs.UserNotFoundError{Username: user}
+	}
+	return auth.LoginWithKey(user, key)
+}
+
+// PasswordChanger is implemented by providers able to store a new password, e.g. when a user
+// with an expired password sets a new one.
+type PasswordChanger interface {
+	SetPassword(user, pass string) error
+}
+
+// RequestAuthenticator is implemented by providers that authenticate the whole request,
+// including the client address and version, instead of the username and a credential only.
+// The server prefers it over Login and LoginWithKey.
+type RequestAuthenticator interface {
+	Authenticate(r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error)
+}
+
+// UserStore is implemented by providers that manage their users, as opposed to providers
+// backed by an external source of truth such as a directory. It lets admin tooling work
+// with any backend. Unknown users are reported with errs.UserNotFoundError.
+type UserStore interface {
+	UserProvider
+	UserGetter
+	KeyAuthenticator
+	PasswordChanger
+	// Create adds a user and fails with errs.UserExistsError when the username is taken.
+	Create(user models.User) error
+	// List returns up to limit users ordered by username, skipping the first offset ones.
+	List(offset, limit int) ([]models.User, error)
+	// Update replaces an existing user identified by its username.
+	Update(user models.User) error
+	Delete(username string) error
+	// AddCredential stores an additional credential. Password and API key credentials are
+	// stored hashed, like User.Password, e.g. with HashPassword.
+	AddCredential(username string, credential models.Credential) error
+}
+
+var (
+	_ KeyAuthenticator = (*ChainProvider)(nil)
+	_ KeyAuthenticator = (*LDAPProvider)(nil)
+	_ KeyAuthenticator = (*WebhookProvider)(nil)
+
+	_ UserGetter = (*ChainProvider)(nil)
+	_ UserGetter = (*LDAPProvider)(nil)
+	_ UserGetter = (*WebhookProvider)(nil)
+
+	_ UserStore = (*JsonFileProvider)(nil)
+	_ UserStore = (*SQLProvider)(nil)
+	_ UserStore = (*ChainProvider)(nil)
+
+	_ GroupResolver = (*JsonFileProvider)(nil)
+	_ GroupResolver = (*SQLProvider)(nil)
+	_ GroupResolver = (*ChainProvider)(nil)
+)
+
+// GroupResolver is implemented by providers whose users inherit settings from groups. Login
+// and LoginWithKey return resolved users; the server resolves the users it looks up with
+// Get, e.g. for certificate logins, while Get itself returns the user as stored.
+type GroupResolver interface {
+	ResolveUser(user models.User) (models.User, error)
+}
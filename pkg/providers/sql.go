@@ -0,0 +1,649 @@
+package providers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// Dialect selects the SQL flavour used by SQLProvider.
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+// migrations are applied in order by Migrate. Each entry is a list of statements where
+// {{id}} is replaced by the auto-increment primary key definition of the dialect.
+var migrations = [][]string{
+	{
+		`CREATE TABLE users (
+			id {{id}},
+			username VARCHAR(255) NOT NULL UNIQUE,
+			password TEXT NOT NULL DEFAULT '',
+			default_filesystem VARCHAR(64) NOT NULL DEFAULT '',
+			permissions TEXT NOT NULL DEFAULT '[]',
+			attributes TEXT NOT NULL DEFAULT '{}',
+			disabled BOOLEAN NOT NULL DEFAULT FALSE,
+			expires_at TIMESTAMP NULL,
+			password_expires_at TIMESTAMP NULL
+		)`,
+		`CREATE TABLE user_filesystems (
+			id {{id}},
+			user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			position INTEGER NOT NULL DEFAULT 0,
+			fs VARCHAR(64) NOT NULL,
+			permissions TEXT NOT NULL DEFAULT '[]',
+			params TEXT NOT NULL DEFAULT '{}'
+		)`,
+		`CREATE INDEX user_filesystems_user_id ON user_filesystems (user_id)`,
+		`CREATE TABLE credentials (
+			credential_id {{id}},
+			user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			credential TEXT NOT NULL,
+			credential_type VARCHAR(32) NOT NULL,
+			provider_type VARCHAR(32) NOT NULL DEFAULT '',
+			integration VARCHAR(32) NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX credentials_user_id ON credentials (user_id)`,
+	},
+	{
+		`ALTER TABLE credentials ADD COLUMN label VARCHAR(255) NOT NULL DEFAULT ''`,
+		`ALTER TABLE credentials ADD COLUMN expires_at TIMESTAMP NULL`,
+		`ALTER TABLE credentials ADD COLUMN last_used_at TIMESTAMP NULL`,
+	},
+	{
+		`CREATE TABLE user_groups (
+			id {{id}},
+			name VARCHAR(255) NOT NULL UNIQUE,
+			definition TEXT NOT NULL DEFAULT '{}'
+		)`,
+	},
+	{
+		`ALTER TABLE user_filesystems ADD COLUMN mount VARCHAR(255) NOT NULL DEFAULT ''`,
+	},
+}
+
+// userAttributes holds the user settings that are never queried on, stored as JSON.
+type userAttributes struct {
+	PublicKeys  []string             `json:"public_keys,omitempty"`
+	TwoFactor   models.TwoFactorMode `json:"two_factor,omitempty"`
+	MaxSessions int                  `json:"max_sessions,omitempty"`
+	AllowedIPs  []string             `json:"allowed_ips,omitempty"`
+	DeniedIPs   []string             `json:"denied_ips,omitempty"`
+	Groups      []string             `json:"groups,omitempty"`
+}
+
+// SQLProvider stores users, their filesystems and credentials through database/sql. The
+// driver must be registered by the application, e.g. a SQLite or a Postgres driver, and the
+// schema created with Migrate.
+type SQLProvider struct {
+	db                *sql.DB
+	dialect           Dialect
+	hashAlgo          string
+	alternateHashAlgo string
+}
+
+// NewSQLProvider creates a provider on db. hashAlgo and alternateHashAlgo behave as for
+// NewJsonFileProvider.
+func NewSQLProvider(db *sql.DB, dialect Dialect, hashAlgo, alternateHashAlgo string) *SQLProvider {
+	if hashAlgo == "" {
+		hashAlgo = "sha256"
+	}
+	return &SQLProvider{db: db, dialect: dialect, hashAlgo: hashAlgo, alternateHashAlgo: alternateHashAlgo}
+}
+
+// Migrate creates or upgrades the schema. Applied migrations are recorded in the
+// schema_migrations table so it is safe to call on every start.
+func (p *SQLProvider) Migrate() error {
+	if _, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var current int
+	if err := p.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for i := current; i < len(migrations); i++ {
+		tx, err := p.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range migrations[i] {
+			if _, err := tx.Exec(strings.ReplaceAll(stmt, "{{id}}", p.idColumn())); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+		}
+		if _, err := tx.Exec(p.rebind(`INSERT INTO schema_migrations (version) VALUES (?)`), i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *SQLProvider) Login(username, pass string) (*fs.AuthenticationResponse, error) {
+	legacy := legacyHashAlgorithm(p.hashAlgo, p.alternateHashAlgo)
+	user, err := p.Get(username)
+	if err != nil {
+		if errs.IsUserNotFoundError(err) {
+			// The response time must not tell whether the account exists.
+			matchDummyPassword(pass, p.hashAlgo, legacy)
+		}
+		return nil, err
+	}
+	now := time.Now()
+	index, algo, matched := matchUserPassword(user, pass, legacy, now)
+	if !matched {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	if err := user.CheckStatus(now); err != nil {
+		return nil, err
+	}
+	if index != userPassword {
+		cred := &user.Credentials[index]
+		_, err = p.db.Exec(p.rebind(`UPDATE credentials SET last_used_at = ? WHERE credential_id = ?`), now.UTC(), cred.CredentialID)
+		if err == nil {
+			cred.LastUsedAt = &now
+		}
+	} else if IsStrongHashAlgorithm(p.hashAlgo) && algo != p.hashAlgo {
+		if encoded, err := HashPassword(pass, p.hashAlgo); err == nil {
+			// The previous hash is part of the condition so a concurrent password change wins.
+			_, err = p.db.Exec(p.rebind(`UPDATE users SET password = ? WHERE username = ? AND password = ?`),
+				encoded, username, user.Password)
+			if err == nil {
+				user.Password = encoded
+			}
+		}
+	}
+	if user, err = p.ResolveUser(user); err != nil {
+		return nil, err
+	}
+	return NewAuthenticationResponse(user), nil
+}
+
+func (p *SQLProvider) LoginWithKey(username string, key ssh.PublicKey) (*fs.AuthenticationResponse, error) {
+	user, err := p.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	if !user.HasPublicKey(key) {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	if err := user.CheckStatus(time.Now()); err != nil {
+		return nil, err
+	}
+	if user, err = p.ResolveUser(user); err != nil {
+		return nil, err
+	}
+	return NewAuthenticationResponse(user), nil
+}
+
+// Register creates or replaces the user. Errors are dropped to satisfy UserProvider, use
+// Save to get them.
+func (p *SQLProvider) Register(user models.User) {
+	_ = p.Save(user)
+}
+
+// Save creates the user, or replaces it together with its filesystems and credentials when
+// a user with the same username exists.
+func (p *SQLProvider) Save(user models.User) error {
+	existing, err := p.Get(user.Username)
+	if err == nil {
+		user.ID = existing.ID
+		return p.Update(user)
+	}
+	if !errs.IsUserNotFoundError(err) {
+		return err
+	}
+	return p.Create(user)
+}
+
+// Create inserts the user with its filesystems and credentials.
+func (p *SQLProvider) Create(user models.User) error {
+	if user.Username == "" {
+		return errors.New("username must not be empty")
+	}
+	return p.inTx(func(tx *sql.Tx) error {
+		var exists int
+		err := tx.QueryRow(p.rebind(`SELECT COUNT(*) FROM users WHERE username = ?`), user.Username).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return errs.UserExistsError{Username: user.Username}
+		}
+		permissions, attributes, err := encodeUser(user)
+		if err != nil {
+			return err
+		}
+		var id int64
+		err = tx.QueryRow(p.rebind(`INSERT INTO users (username, password, default_filesystem, permissions, attributes, disabled, expires_at, password_expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`),
+			user.Username, user.Password, user.DefaultFilesystem, permissions, attributes,
+			user.Disabled, nullTime(user.ExpiresAt), nullTime(user.PasswordExpiresAt),
+		).Scan(&id)
+		if err != nil {
+			return err
+		}
+		return p.saveRelations(tx, id, user)
+	})
+}
+
+// Update replaces the user identified by its username, including its filesystems and credentials.
+func (p *SQLProvider) Update(user models.User) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		permissions, attributes, err := encodeUser(user)
+		if err != nil {
+			return err
+		}
+		var id int64
+		err = tx.QueryRow(p.rebind(`UPDATE users SET password = ?, default_filesystem = ?, permissions = ?, attributes = ?,
+			disabled = ?, expires_at = ?, password_expires_at = ? WHERE username = ? RETURNING id`),
+			user.Password, user.DefaultFilesystem, permissions, attributes,
+			user.Disabled, nullTime(user.ExpiresAt), nullTime(user.PasswordExpiresAt), user.Username,
+		).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errs.UserNotFoundError{Username: user.Username}
+		}
+		if err != nil {
+			return err
+		}
+		for _, stmt := range []string{`DELETE FROM user_filesystems WHERE user_id = ?`, `DELETE FROM credentials WHERE user_id = ?`} {
+			if _, err := tx.Exec(p.rebind(stmt), id); err != nil {
+				return err
+			}
+		}
+		return p.saveRelations(tx, id, user)
+	})
+}
+
+// Delete removes the user with its filesystems and credentials.
+func (p *SQLProvider) Delete(username string) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRow(p.rebind(`SELECT id FROM users WHERE username = ?`), username).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errs.UserNotFoundError{Username: username}
+		}
+		if err != nil {
+			return err
+		}
+		// Not every SQLite connection enforces foreign keys, so relations are removed explicitly.
+		for _, stmt := range []string{
+			`DELETE FROM user_filesystems WHERE user_id = ?`,
+			`DELETE FROM credentials WHERE user_id = ?`,
+			`DELETE FROM users WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(p.rebind(stmt), id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddCredential stores an additional credential for the user.
+func (p *SQLProvider) AddCredential(username string, credential models.Credential) error {
+	return p.inTx(func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRow(p.rebind(`SELECT id FROM users WHERE username = ?`), username).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errs.UserNotFoundError{Username: username}
+		}
+		if err != nil {
+			return err
+		}
+		return p.insertCredential(tx, id, credential)
+	})
+}
+
+// SetPassword stores a new password for the user with the configured algorithm and clears
+// its password expiry.
+func (p *SQLProvider) SetPassword(username, pass string) error {
+	if pass == "" {
+		return errors.New("password must not be empty")
+	}
+	encoded, err := HashPassword(pass, p.hashAlgo)
+	if err != nil {
+		return err
+	}
+	res, err := p.db.Exec(p.rebind(`UPDATE users SET password = ?, password_expires_at = NULL WHERE username = ?`), encoded, username)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errs.UserNotFoundError{Username: username}
+	}
+	return nil
+}
+
+func (p *SQLProvider) Get(username string) (models.User, error) {
+	row := p.db.QueryRow(p.rebind(`SELECT `+userColumns+` FROM users WHERE username = ?`), username)
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.User{}, errs.UserNotFoundError{Username: username}
+	}
+	if err != nil {
+		return models.User{}, err
+	}
+	if err := p.loadRelations(&user); err != nil {
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// List returns up to limit users ordered by username, skipping the first offset ones.
+func (p *SQLProvider) List(offset, limit int) ([]models.User, error) {
+	rows, err := p.db.Query(p.rebind(`SELECT `+userColumns+` FROM users ORDER BY username LIMIT ? OFFSET ?`), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	var users []models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if err := p.loadRelations(&users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// ResolveUser merges the groups of the user into it.
+func (p *SQLProvider) ResolveUser(user models.User) (models.User, error) {
+	if len(user.Groups) == 0 {
+		return user, nil
+	}
+	groups := make(map[string]models.Group, len(user.Groups))
+	for _, name := range user.Groups {
+		group, err := p.GetGroup(name)
+		if errs.IsGroupNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return user, err
+		}
+		groups[name] = group
+	}
+	return user.ResolveGroups(groups), nil
+}
+
+func (p *SQLProvider) GetGroup(name string) (models.Group, error) {
+	var definition string
+	err := p.db.QueryRow(p.rebind(`SELECT definition FROM user_groups WHERE name = ?`), name).Scan(&definition)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Group{}, errs.GroupNotFoundError{Name: name}
+	}
+	if err != nil {
+		return models.Group{}, err
+	}
+	var group models.Group
+	if err := json.Unmarshal([]byte(definition), &group); err != nil {
+		return models.Group{}, err
+	}
+	group.Name = name
+	return group, nil
+}
+
+// ListGroups returns all groups ordered by name.
+func (p *SQLProvider) ListGroups() ([]models.Group, error) {
+	rows, err := p.db.Query(`SELECT name, definition FROM user_groups ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []models.Group
+	for rows.Next() {
+		var name, definition string
+		if err := rows.Scan(&name, &definition); err != nil {
+			return nil, err
+		}
+		var group models.Group
+		if err := json.Unmarshal([]byte(definition), &group); err != nil {
+			return nil, err
+		}
+		group.Name = name
+		groups = append(groups, group)
+	}
+	return groups, rows.Err()
+}
+
+// SaveGroup creates or replaces a group. Members see the change on their next login.
+func (p *SQLProvider) SaveGroup(group models.Group) error {
+	if group.Name == "" {
+		return errors.New("group name must not be empty")
+	}
+	definition, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(p.rebind(`INSERT INTO user_groups (name, definition) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET definition = excluded.definition`), group.Name, string(definition))
+	return err
+}
+
+// DeleteGroup removes a group. Members keep naming it and inherit nothing from it.
+func (p *SQLProvider) DeleteGroup(name string) error {
+	res, err := p.db.Exec(p.rebind(`DELETE FROM user_groups WHERE name = ?`), name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errs.GroupNotFoundError{Name: name}
+	}
+	return nil
+}
+
+const userColumns = `id, username, password, default_filesystem, permissions, attributes, disabled, expires_at, password_expires_at`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanUser(row scanner) (models.User, error) {
+	var user models.User
+	var permissions, attributes string
+	var expiresAt, passwordExpiresAt sql.NullTime
+	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.DefaultFilesystem, &permissions, &attributes,
+		&user.Disabled, &expiresAt, &passwordExpiresAt)
+	if err != nil {
+		return user, err
+	}
+	if err := json.Unmarshal([]byte(permissions), &user.Permissions); err != nil {
+		return user, err
+	}
+	var attrs userAttributes
+	if err := json.Unmarshal([]byte(attributes), &attrs); err != nil {
+		return user, err
+	}
+	user.PublicKeys = attrs.PublicKeys
+	user.TwoFactor = attrs.TwoFactor
+	user.MaxSessions = attrs.MaxSessions
+	user.AllowedIPs = attrs.AllowedIPs
+	user.DeniedIPs = attrs.DeniedIPs
+	user.Groups = attrs.Groups
+	if expiresAt.Valid {
+		user.ExpiresAt = &expiresAt.Time
+	}
+	if passwordExpiresAt.Valid {
+		user.PasswordExpiresAt = &passwordExpiresAt.Time
+	}
+	return user, nil
+}
+
+func encodeUser(user models.User) (string, string, error) {
+	permissions := user.Permissions
+	if permissions == nil {
+		permissions = []string{}
+	}
+	perm, err := json.Marshal(permissions)
+	if err != nil {
+		return "", "", err
+	}
+	attrs, err := json.Marshal(userAttributes{
+		PublicKeys:  user.PublicKeys,
+		TwoFactor:   user.TwoFactor,
+		MaxSessions: user.MaxSessions,
+		AllowedIPs:  user.AllowedIPs,
+		DeniedIPs:   user.DeniedIPs,
+		Groups:      user.Groups,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return string(perm), string(attrs), nil
+}
+
+func (p *SQLProvider) loadRelations(user *models.User) error {
+	rows, err := p.db.Query(p.rebind(`SELECT fs, permissions, params, mount FROM user_filesystems WHERE user_id = ? ORDER BY position`), user.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fst models.Filesystem
+		var permissions, params string
+		if err := rows.Scan(&fst.Fs, &permissions, &params, &fst.Mount); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(permissions), &fst.Permissions); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(params), &fst.Params); err != nil {
+			return err
+		}
+		user.Filesystems = append(user.Filesystems, &fst)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	credRows, err := p.db.Query(p.rebind(`SELECT credential_id, user_id, credential, credential_type, provider_type, integration,
+		label, expires_at, last_used_at FROM credentials WHERE user_id = ? ORDER BY credential_id`), user.ID)
+	if err != nil {
+		return err
+	}
+	defer credRows.Close()
+	for credRows.Next() {
+		var cred models.Credential
+		var expiresAt, lastUsedAt sql.NullTime
+		if err := credRows.Scan(&cred.CredentialID, &cred.UserID, &cred.Credential, &cred.CredentialType,
+			&cred.ProviderType, &cred.Integration, &cred.Label, &expiresAt, &lastUsedAt); err != nil {
+			return err
+		}
+		if expiresAt.Valid {
+			cred.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			cred.LastUsedAt = &lastUsedAt.Time
+		}
+		user.Credentials = append(user.Credentials, cred)
+	}
+	return credRows.Err()
+}
+
+func (p *SQLProvider) saveRelations(tx *sql.Tx, id int64, user models.User) error {
+	for i, fst := range user.Filesystems {
+		if fst == nil {
+			continue
+		}
+		permissions := fst.Permissions
+		if permissions == nil {
+			permissions = []string{}
+		}
+		perm, err := json.Marshal(permissions)
+		if err != nil {
+			return err
+		}
+		params, err := json.Marshal(fst.Params)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(p.rebind(`INSERT INTO user_filesystems (user_id, position, fs, permissions, params, mount) VALUES (?, ?, ?, ?, ?, ?)`),
+			id, i, fst.Fs, string(perm), string(params), fst.Mount); err != nil {
+			return err
+		}
+	}
+	for _, cred := range user.Credentials {
+		if err := p.insertCredential(tx, id, cred); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *SQLProvider) insertCredential(tx *sql.Tx, id int64, cred models.Credential) error {
+	_, err := tx.Exec(p.rebind(`INSERT INTO credentials (user_id, credential, credential_type, provider_type, integration, label, expires_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		id, cred.Credential, cred.CredentialType, cred.ProviderType, cred.Integration,
+		cred.Label, nullTime(cred.ExpiresAt), nullTime(cred.LastUsedAt))
+	return err
+}
+
+func (p *SQLProvider) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *SQLProvider) idColumn() string {
+	if p.dialect == Postgres {
+		return "BIGSERIAL PRIMARY KEY"
+	}
+	return "INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+// rebind rewrites ? placeholders to the $n form expected by Postgres.
+func (p *SQLProvider) rebind(query string) string {
+	if p.dialect != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: *t, Valid: true}
+}
@@ -0,0 +1,253 @@
+package providers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	_ "modernc.org/sqlite"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+func newTestSQLProvider(t *testing.T) *SQLProvider {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SQLite allows a single writer, the provider writes from one connection at a time.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	p := NewSQLProvider(db, SQLite, Argon2id, "sha256")
+	if err := p.Migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return p
+}
+
+func newTestKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSQLProviderMigrate(t *testing.T) {
+	p := newTestSQLProvider(t)
+	// Migrations already applied are skipped.
+	if err := p.Migrate(); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+	var version int
+	if err := p.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Fatalf("schema version = %d, want %d", version, len(migrations))
+	}
+}
+
+func TestSQLProviderLifecycle(t *testing.T) {
+	p := newTestSQLProvider(t)
+	key := newTestKey(t)
+	legacy, err := HashPassword("secret", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey, err := HashPassword("api-key", Argon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	user := models.User{
+		Username:    "alice",
+		Password:    legacy,
+		Permissions: []string{"read", "create"},
+		PublicKeys:  []string{string(ssh.MarshalAuthorizedKey(key))},
+		MaxSessions: 2,
+		AllowedIPs:  []string{"10.0.0.0/8"},
+		ExpiresAt:   &expires,
+		Filesystems: []*models.Filesystem{
+			{Fs: "os", Permissions: []string{"read"}, Params: map[string]any{"base_path": "/srv/alice"}},
+			{Fs: "memory", Mount: "/inbox", Params: map[string]any{"volume": "inbox"}},
+		},
+		Credentials: []models.Credential{
+			{Credential: apiKey, CredentialType: models.APIKey, Integration: models.SFTP, Label: "ci"},
+		},
+	}
+	if err := p.Create(user); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := p.Create(user); !errors.As(err, new(errs.UserExistsError)) {
+		t.Fatalf("create duplicate: got %v, want UserExistsError", err)
+	}
+
+	got, err := p.Get("alice")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.MaxSessions != 2 || len(got.AllowedIPs) != 1 || got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) {
+		t.Fatalf("attributes not loaded: %+v", got)
+	}
+	if len(got.Filesystems) != 2 || got.Filesystems[0].Fs != "os" || got.Filesystems[1].Fs != "memory" {
+		t.Fatalf("filesystems not loaded in order: %+v", got.Filesystems)
+	}
+	if got.Filesystems[0].Params["base_path"] != "/srv/alice" || got.Filesystems[0].Permissions[0] != "read" || got.Filesystems[1].Mount != "/inbox" {
+		t.Fatalf("filesystem settings not loaded: %+v", got.Filesystems[0])
+	}
+	if len(got.Credentials) != 1 || got.Credentials[0].Label != "ci" || got.Credentials[0].CredentialType != models.APIKey {
+		t.Fatalf("credentials not loaded: %+v", got.Credentials)
+	}
+
+	// A legacy hash is accepted and replaced by the configured algorithm.
+	if _, err := p.Login("alice", "wrong"); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login with a wrong password: got %v, want InvalidCredentialsError", err)
+	}
+	if _, err := p.Login("alice", "secret"); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	got, err = p.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got.Password, "$argon2id$") {
+		t.Fatalf("password not rehashed: %q", got.Password)
+	}
+	if _, err := p.Login("alice", "secret"); err != nil {
+		t.Fatalf("login after rehash: %v", err)
+	}
+
+	// Additional credentials log in too and record their last use.
+	if _, err := p.Login("alice", "api-key"); err != nil {
+		t.Fatalf("login with api key: %v", err)
+	}
+	got, err = p.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Credentials[0].LastUsedAt == nil {
+		t.Fatal("last use of the credential not recorded")
+	}
+
+	if _, err := p.LoginWithKey("alice", key); err != nil {
+		t.Fatalf("login with key: %v", err)
+	}
+	if _, err := p.LoginWithKey("alice", newTestKey(t)); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login with an unknown key: got %v, want InvalidCredentialsError", err)
+	}
+	if _, err := p.LoginWithKey("bob", key); !errs.IsUserNotFoundError(err) {
+		t.Fatalf("login of an unknown user: got %v, want UserNotFoundError", err)
+	}
+
+	got.Permissions = []string{"read"}
+	got.PublicKeys = nil
+	got.Filesystems = got.Filesystems[1:]
+	if err := p.Update(got); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	got, err = p.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Permissions) != 1 || len(got.Filesystems) != 1 || got.Filesystems[0].Mount != "/inbox" || len(got.Credentials) != 1 {
+		t.Fatalf("update not stored: %+v", got)
+	}
+	if _, err := p.LoginWithKey("alice", key); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login with a removed key: got %v, want InvalidCredentialsError", err)
+	}
+	if err := p.Update(models.User{Username: "bob"}); !errs.IsUserNotFoundError(err) {
+		t.Fatalf("update of an unknown user: got %v, want UserNotFoundError", err)
+	}
+
+	if err := p.SetPassword("alice", "changed"); err != nil {
+		t.Fatalf("set password: %v", err)
+	}
+	if _, err := p.Login("alice", "changed"); err != nil {
+		t.Fatalf("login with the new password: %v", err)
+	}
+
+	if err := p.Delete("alice"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := p.Get("alice"); !errs.IsUserNotFoundError(err) {
+		t.Fatalf("get after delete: got %v, want UserNotFoundError", err)
+	}
+	for _, table := range []string{"user_filesystems", "credentials"} {
+		var count int
+		if err := p.db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Fatalf("%d rows left in %s", count, table)
+		}
+	}
+	if err := p.Delete("alice"); !errs.IsUserNotFoundError(err) {
+		t.Fatalf("second delete: got %v, want UserNotFoundError", err)
+	}
+}
+
+func TestSQLProviderGroups(t *testing.T) {
+	p := newTestSQLProvider(t)
+	if err := p.SaveGroup(models.Group{Name: "staff", Permissions: []string{"read"}, MaxSessions: 3}); err != nil {
+		t.Fatalf("save group: %v", err)
+	}
+	pass, err := HashPassword("secret", Argon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Create(models.User{Username: "alice", Password: pass, Groups: []string{"staff", "missing"}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.Login("alice", "secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if resp.User.MaxSessions != 3 || len(resp.User.Permissions) != 1 || resp.User.Permissions[0] != "read" {
+		t.Fatalf("group not merged: %+v", resp.User)
+	}
+	if err := p.DeleteGroup("staff"); err != nil {
+		t.Fatalf("delete group: %v", err)
+	}
+	if err := p.DeleteGroup("staff"); !errs.IsGroupNotFoundError(err) {
+		t.Fatalf("second delete: got %v, want GroupNotFoundError", err)
+	}
+}
+
+func TestSQLProviderUnknownUserTiming(t *testing.T) {
+	p := newTestSQLProvider(t)
+	pass, err := HashPassword("secret", Argon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Create(models.User{Username: "alice", Password: pass}); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := func(username string) time.Duration {
+		start := time.Now()
+		if _, err := p.Login(username, "wrong"); err == nil {
+			t.Fatalf("login of %s with a wrong password succeeded", username)
+		}
+		return time.Since(start)
+	}
+	// The first unknown login also hashes the dummy password.
+	elapsed("bob")
+	known, unknown := elapsed("alice"), elapsed("bob")
+	// Unknown users are compared against a hash as well, a lookup alone is far quicker.
+	if unknown < known/3 {
+		t.Fatalf("unknown user rejected in %s, a wrong password in %s", unknown, known)
+	}
+}
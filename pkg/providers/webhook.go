@@ -0,0 +1,295 @@
+package providers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+const (
+	// WebhookSignatureHeader carries the hex encoded HMAC-SHA256 of the timestamp, a dot and
+	// the request body, keyed with WebhookConfig.Secret.
+	WebhookSignatureHeader = "X-Sftp-Signature"
+	// WebhookTimestampHeader carries the unix time the request was signed at, so that the
+	// receiver can reject replayed requests.
+	WebhookTimestampHeader = "X-Sftp-Timestamp"
+)
+
+type WebhookConfig struct {
+	// URL receives the fs.AuthenticationRequest as a JSON POST and answers with an
+	// fs.AuthenticationResponse. 401 and 403 answers reject the credentials, 404 answers
+	// report an unknown user.
+	URL string
+	// UserURL, when set, is queried with GET and a username parameter to look up a user
+	// without credentials, e.g. for certificate logins. It answers with a models.User.
+	UserURL string
+	// Timeout bounds every attempt and defaults to 10 seconds.
+	Timeout time.Duration
+	// Retries is the number of extra attempts after network errors, 429 and 5xx answers.
+	// RetryBackoff is the delay before the first retry and doubles with each one.
+	Retries      int
+	RetryBackoff time.Duration
+	// Secret signs every request when set, see WebhookSignatureHeader.
+	Secret []byte
+	// Headers are added to every request, e.g. an API token.
+	Headers map[string]string
+	// CertFile and KeyFile are the client certificate presented for mutual TLS, CAFile the
+	// authorities trusted for the server certificate instead of the system pool.
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// CacheTTL is how long accepted credentials are answered from memory. Zero disables the
+	// cache, so that the identity service sees every login.
+	CacheTTL time.Duration
+	// Client replaces the HTTP client built from the settings above.
+	Client *http.Client
+}
+
+type webhookCache struct {
+	resp      fs.AuthenticationResponse
+	expiresAt time.Time
+}
+
+// WebhookProvider delegates authentication to an HTTP identity service which remains the
+// source of truth for users. It implements RequestAuthenticator so that the service also
+// receives the client address and version.
+type WebhookProvider struct {
+	config WebhookConfig
+	client *http.Client
+	cache  map[[sha256.Size]byte]webhookCache
+	mu     sync.Mutex
+}
+
+// NewWebhookProvider fails when the client certificate or the authorities cannot be loaded.
+func NewWebhookProvider(config WebhookConfig) (*WebhookProvider, error) {
+	if config.URL == "" {
+		return nil, errors.New("webhook url is required")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 200 * time.Millisecond
+	}
+	client := config.Client
+	if client == nil {
+		tlsConfig, err := config.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client = &http.Client{Transport: transport, Timeout: config.Timeout}
+	}
+	return &WebhookProvider{
+		config: config,
+		client: client,
+		cache:  make(map[[sha256.Size]byte]webhookCache),
+	}, nil
+}
+
+func (c WebhookConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("webhook client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("webhook ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("webhook ca: no certificate found in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func (p *WebhookProvider) Login(username, pass string) (*fs.AuthenticationResponse, error) {
+	return p.Authenticate(fs.AuthenticationRequest{User: username, Pass: pass})
+}
+
+func (p *WebhookProvider) LoginWithKey(username string, key ssh.PublicKey) (*fs.AuthenticationResponse, error) {
+	return p.Authenticate(fs.AuthenticationRequest{
+		User:      username,
+		PublicKey: string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key))),
+	})
+}
+
+// Authenticate posts the request to the identity service. Accepted credentials are cached
+// for CacheTTL, keyed by the username, the password and the public key only.
+func (p *WebhookProvider) Authenticate(r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error) {
+	key := sha256.Sum256([]byte(r.User + "\x00" + r.Pass + "\x00" + r.PublicKey))
+	if resp, ok := p.cached(key); ok {
+		return resp, nil
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var resp fs.AuthenticationResponse
+	if err := p.do(http.MethodPost, p.config.URL, body, &resp); err != nil {
+		if errs.IsUserNotFoundError(err) {
+			return nil, errs.UserNotFoundError{Username: r.User}
+		}
+		return nil, err
+	}
+	if resp.User.Username == "" {
+		resp.User.Username = r.User
+	}
+	if err := resp.User.CheckStatus(time.Now()); err != nil {
+		return nil, err
+	}
+	p.store(key, resp)
+	return &resp, nil
+}
+
+// Get looks the user up with UserURL. Without it, every user is unknown.
+func (p *WebhookProvider) Get(username string) (models.User, error) {
+	if p.config.UserURL == "" {
+		return models.User{}, errs.UserNotFoundError{Username: username}
+	}
+	target, err := url.Parse(p.config.UserURL)
+	if err != nil {
+		return models.User{}, err
+	}
+	query := target.Query()
+	query.Set("username", username)
+	target.RawQuery = query.Encode()
+	var user models.User
+	if err := p.do(http.MethodGet, target.String(), nil, &user); err != nil {
+		if errs.IsUserNotFoundError(err) {
+			return models.User{}, errs.UserNotFoundError{Username: username}
+		}
+		return models.User{}, err
+	}
+	return user, nil
+}
+
+// Register is a no-op: users are managed by the identity service.
+func (p *WebhookProvider) Register(models.User) {}
+
+// do sends a request, retrying transient failures, and decodes a successful answer into out.
+func (p *WebhookProvider) do(method, target string, body []byte, out any) error {
+	backoff := p.config.RetryBackoff
+	var err error
+	for attempt := 0; attempt <= p.config.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		retry, err = p.attempt(method, target, body, out)
+		if !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *WebhookProvider) attempt(method, target string, body []byte, out any) (bool, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, val := range p.config.Headers {
+		req.Header.Set(key, val)
+	}
+	if len(p.config.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(p.config.Secret, timestamp, body))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("webhook: %w", err)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusOK:
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			return false, fmt.Errorf("webhook: invalid response: %w", err)
+		}
+		return false, nil
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		return false, errs.InvalidCredentialsError{}
+	case res.StatusCode == http.StatusNotFound:
+		return false, errs.UserNotFoundError{}
+	default:
+		io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+		retry := res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		return retry, fmt.Errorf("webhook: unexpected status %s", res.Status)
+	}
+}
+
+// SignWebhook returns the signature of a request body sent at timestamp, as found in the
+// WebhookSignatureHeader. Receivers use it to verify requests.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *WebhookProvider) cached(key [sha256.Size]byte) (*fs.AuthenticationResponse, bool) {
+	if p.config.CacheTTL <= 0 {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry, exists := p.cache[key]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(p.cache, key)
+		return nil, false
+	}
+	resp := entry.resp
+	return &resp, true
+}
+
+func (p *WebhookProvider) store(key [sha256.Size]byte, resp fs.AuthenticationResponse) {
+	if p.config.CacheTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, entry := range p.cache {
+		if now.After(entry.expiresAt) {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[key] = webhookCache{resp: resp, expiresAt: now.Add(p.config.CacheTTL)}
+}
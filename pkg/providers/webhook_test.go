@@ -0,0 +1,192 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/fs"
+)
+
+// newTestWebhook starts an identity service accepting alice with the password secret.
+func newTestWebhook(t *testing.T, secret []byte) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if secret != nil {
+			timestamp := r.Header.Get(WebhookTimestampHeader)
+			if r.Header.Get(WebhookSignatureHeader) != SignWebhook(secret, timestamp, body) {
+				http.Error(w, "bad signature", http.StatusUnauthorized)
+				return
+			}
+		}
+		if r.Method == http.MethodGet {
+			if r.URL.Query().Get("username") != "alice" {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"username": "alice", "permissions": []string{"read"}})
+			return
+		}
+		var req fs.AuthenticationRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case req.User != "alice":
+			http.NotFound(w, r)
+		case req.Pass != "secret":
+			http.Error(w, "denied", http.StatusForbidden)
+		default:
+			json.NewEncoder(w).Encode(map[string]any{
+				"user": map[string]any{"permissions": []string{"read", "create"}, "max_sessions": 3},
+			})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestWebhookProviderLogin(t *testing.T) {
+	secret := []byte("shared secret")
+	server, calls := newTestWebhook(t, secret)
+	p, err := NewWebhookProvider(WebhookConfig{
+		URL:     server.URL + "/auth",
+		UserURL: server.URL + "/users",
+		Secret:  secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p.Login("alice", "secret")
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	// The username defaults to the one that logged in.
+	if resp.User.Username != "alice" || resp.User.MaxSessions != 3 || strings.Join(resp.User.Permissions, ",") != "read,create" {
+		t.Fatalf("response not decoded: %+v", resp.User)
+	}
+	if _, err := p.Login("alice", "wrong"); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login with a wrong password: got %v, want InvalidCredentialsError", err)
+	}
+	if _, err := p.Login("bob", "secret"); !errs.IsUserNotFoundError(err) {
+		t.Fatalf("login of an unknown user: got %v, want UserNotFoundError", err)
+	}
+	user, err := p.Get("alice")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if user.Username != "alice" || len(user.Permissions) != 1 {
+		t.Fatalf("user not decoded: %+v", user)
+	}
+	if _, err := p.Get("bob"); !errs.IsUserNotFoundError(err) {
+		t.Fatalf("get of an unknown user: got %v, want UserNotFoundError", err)
+	}
+	if n := calls.Load(); n != 5 {
+		t.Fatalf("%d calls, want 5 without a cache", n)
+	}
+
+	// Requests signed with another secret are refused by the service.
+	p, err = NewWebhookProvider(WebhookConfig{URL: server.URL, Secret: []byte("other")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Login("alice", "secret"); !errors.As(err, new(errs.InvalidCredentialsError)) {
+		t.Fatalf("login with a bad signature: got %v, want InvalidCredentialsError", err)
+	}
+}
+
+func TestWebhookProviderCache(t *testing.T) {
+	server, calls := newTestWebhook(t, nil)
+	p, err := NewWebhookProvider(WebhookConfig{URL: server.URL, CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := p.Login("alice", "secret"); err != nil {
+			t.Fatalf("login %d: %v", i, err)
+		}
+	}
+	if _, err := p.Login("alice", "wrong"); err == nil {
+		t.Fatal("login with a wrong password succeeded")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("%d calls, want one per distinct credential", n)
+	}
+}
+
+func TestWebhookProviderErrors(t *testing.T) {
+	var calls atomic.Int32
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		switch code := int(status.Load()); code {
+		case http.StatusOK:
+			io.WriteString(w, "not json")
+		case http.StatusGatewayTimeout:
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.WriteHeader(code)
+		}
+	}))
+	defer server.Close()
+	p, err := NewWebhookProvider(WebhookConfig{
+		URL:          server.URL,
+		Retries:      2,
+		RetryBackoff: time.Millisecond,
+		Timeout:      50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Server errors are retried.
+	if _, err := p.Login("alice", "secret"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got %v, want the unexpected status", err)
+	}
+	if n := calls.Swap(0); n != 3 {
+		t.Fatalf("%d attempts, want 3", n)
+	}
+
+	// Client errors are not.
+	status.Store(http.StatusBadRequest)
+	if _, err := p.Login("alice", "secret"); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("got %v, want the unexpected status", err)
+	}
+	if n := calls.Swap(0); n != 1 {
+		t.Fatalf("%d attempts, want 1", n)
+	}
+
+	status.Store(http.StatusOK)
+	if _, err := p.Login("alice", "secret"); err == nil || !strings.Contains(err.Error(), "invalid response") {
+		t.Fatalf("got %v, want an invalid response", err)
+	}
+	calls.Store(0)
+
+	// Slow answers time out and are retried like network errors.
+	status.Store(http.StatusGatewayTimeout)
+	start := time.Now()
+	if _, err := p.Login("alice", "secret"); err == nil {
+		t.Fatal("login succeeded despite the timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout not enforced, login took %s", elapsed)
+	}
+	if n := calls.Swap(0); n != 3 {
+		t.Fatalf("%d attempts, want 3", n)
+	}
+}
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store keeping failures and bans in memory. It is the default store and
+// only protects a single server process.
+type MemoryStore struct {
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	bans      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]time.Time),
+	}
+}
+
+func (s *MemoryStore) AddFailure(key string, now time.Time, window time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.lastSweep) > window {
+		s.sweep(now, window)
+	}
+	failures := append(prune(s.failures[key], now.Add(-window)), now)
+	s.failures[key] = failures
+	return len(failures), nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, key)
+	return nil
+}
+
+func (s *MemoryStore) Ban(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[key] = until
+	return nil
+}
+
+func (s *MemoryStore) BannedUntil(key string, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.bans[key]
+	if !ok {
+		return time.Time{}, nil
+	}
+	if !until.After(now) {
+		delete(s.bans, key)
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// sweep drops expired failures and bans so keys that are never seen again do not leak.
+func (s *MemoryStore) sweep(now time.Time, window time.Duration) {
+	for key, failures := range s.failures {
+		if failures = prune(failures, now.Add(-window)); len(failures) == 0 {
+			delete(s.failures, key)
+		} else {
+			s.failures[key] = failures
+		}
+	}
+	for key, until := range s.bans {
+		if !until.After(now) {
+			delete(s.bans, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+// prune removes the failures that happened before since.
+func prune(failures []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(failures) && !failures[i].After(since) {
+		i++
+	}
+	return failures[i:]
+}
@@ -0,0 +1,227 @@
+// Package ratelimit protects the server against brute-force attacks by counting failed logins
+// per source IP and per username over a sliding window and banning offenders for a while.
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Kind tells whether a ban applies to a source IP or to a username.
+type Kind string
+
+const (
+	IP   Kind = "ip"
+	User Kind = "user"
+)
+
+// Event is emitted when an IP or a user is banned or unbanned.
+type Event struct {
+	Kind   Kind      `json:"kind"`
+	Value  string    `json:"value"`
+	Banned bool      `json:"banned"`
+	Until  time.Time `json:"until"`
+}
+
+// BannedError is returned by Allow while an IP or a user is banned.
+type BannedError struct {
+	Kind  Kind
+	Value string
+	Until time.Time
+}
+
+func (e *BannedError) Error() string {
+	return fmt.Sprintf("%s %s is banned until %s", e.Kind, e.Value, e.Until.Format(time.RFC3339))
+}
+
+// Limiter decides whether a login attempt may proceed based on previous failures.
+type Limiter interface {
+	// Allow returns a *BannedError when the IP or the user is currently banned. An empty
+	// value skips the corresponding check.
+	Allow(ip, user string) error
+	// Failure records a failed login.
+	Failure(ip, user string)
+	// Success records a successful login and forgets the previous failures of the user.
+	// Failures of the IP are kept, as other users may be attacked from it.
+	Success(ip, user string)
+	// Notify registers the function called when an IP or a user is banned or unbanned.
+	Notify(handler func(Event))
+}
+
+// Store keeps failed attempts and bans. Implementing it on top of a shared database lets
+// several servers enforce the same bans. Implementations must be safe for concurrent use.
+type Store interface {
+	// AddFailure records a failure for key at now and returns the number of failures
+	// recorded within the window ending at now.
+	AddFailure(key string, now time.Time, window time.Duration) (int, error)
+	// Reset forgets the failures recorded for key.
+	Reset(key string) error
+	// Ban bans key until the given time.
+	Ban(key string, until time.Time) error
+	// BannedUntil returns the end of the ban of key, or the zero time if it is not banned.
+	BannedUntil(key string, now time.Time) (time.Time, error)
+}
+
+// FailureLimiter is the default Limiter. It bans an IP after MaxIPFailures and locks a user
+// after MaxUserFailures failed logins within Window.
+type FailureLimiter struct {
+	store           Store
+	window          time.Duration
+	maxIPFailures   int
+	maxUserFailures int
+	ipBan           time.Duration
+	userLock        time.Duration
+	mu              sync.RWMutex
+	handler         func(Event)
+	onError         func(err error)
+	clock           func() time.Time
+}
+
+// New creates a FailureLimiter using the given store, an in-memory one when nil. By default it
+// bans an IP for 15 minutes after 10 failures and locks a user for 15 minutes after 5
+// failures within 10 minutes.
+func New(store Store, opts ...func(*FailureLimiter)) *FailureLimiter {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	l := &FailureLimiter{
+		store:           store,
+		window:          10 * time.Minute,
+		maxIPFailures:   10,
+		maxUserFailures: 5,
+		ipBan:           15 * time.Minute,
+		userLock:        15 * time.Minute,
+		clock:           time.Now,
+	}
+	for _, o := range opts {
+		o(l)
+	}
+	return l
+}
+
+// WithWindow sets the sliding window failures are counted over.
+func WithWindow(val time.Duration) func(*FailureLimiter) {
+	return func(o *FailureLimiter) {
+		o.window = val
+	}
+}
+
+// WithIPBan bans an IP for duration after max failures. A max of zero disables IP bans.
+func WithIPBan(max int, duration time.Duration) func(*FailureLimiter) {
+	return func(o *FailureLimiter) {
+		o.maxIPFailures = max
+		o.ipBan = duration
+	}
+}
+
+// WithUserLock locks a user for duration after max failures. A max of zero disables locking.
+func WithUserLock(max int, duration time.Duration) func(*FailureLimiter) {
+	return func(o *FailureLimiter) {
+		o.maxUserFailures = max
+		o.userLock = duration
+	}
+}
+
+// WithErrorHandler sets the function called when the store fails. Store failures never
+// block logins.
+func WithErrorHandler(val func(err error)) func(*FailureLimiter) {
+	return func(o *FailureLimiter) {
+		o.onError = val
+	}
+}
+
+// WithClock sets the function returning the current time, e.g. to test the window and the
+// ban durations. The end of bans is still notified after their duration in real time.
+func WithClock(val func() time.Time) func(*FailureLimiter) {
+	return func(o *FailureLimiter) {
+		o.clock = val
+	}
+}
+
+func (l *FailureLimiter) Notify(handler func(Event)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handler = handler
+}
+
+func (l *FailureLimiter) Allow(ip, user string) error {
+	now := l.clock()
+	if err := l.allow(IP, ip, now); err != nil {
+		return err
+	}
+	return l.allow(User, user, now)
+}
+
+func (l *FailureLimiter) allow(kind Kind, value string, now time.Time) error {
+	if value == "" {
+		return nil
+	}
+	until, err := l.store.BannedUntil(key(kind, value), now)
+	if err != nil {
+		l.error(err)
+		return nil
+	}
+	if until.After(now) {
+		return &BannedError{Kind: kind, Value: value, Until: until}
+	}
+	return nil
+}
+
+func (l *FailureLimiter) Failure(ip, user string) {
+	now := l.clock()
+	l.failure(IP, ip, l.maxIPFailures, l.ipBan, now)
+	l.failure(User, user, l.maxUserFailures, l.userLock, now)
+}
+
+func (l *FailureLimiter) failure(kind Kind, value string, max int, duration time.Duration, now time.Time) {
+	if value == "" || max <= 0 {
+		return
+	}
+	k := key(kind, value)
+	count, err := l.store.AddFailure(k, now, l.window)
+	if err != nil {
+		l.error(err)
+		return
+	}
+	if count < max {
+		return
+	}
+	until := now.Add(duration)
+	if err := l.store.Ban(k, until); err != nil {
+		l.error(err)
+		return
+	}
+	if err := l.store.Reset(k); err != nil {
+		l.error(err)
+	}
+	l.emit(Event{Kind: kind, Value: value, Banned: true, Until: until})
+	time.AfterFunc(duration, func() {
+		l.emit(Event{Kind: kind, Value: value, Banned: false, Until: until})
+	})
+}
+
+func (l *FailureLimiter) Success(ip, user string) {
+	if err := l.store.Reset(key(User, user)); err != nil {
+		l.error(err)
+	}
+}
+
+func (l *FailureLimiter) emit(event Event) {
+	l.mu.RLock()
+	handler := l.handler
+	l.mu.RUnlock()
+	if handler != nil {
+		handler(event)
+	}
+}
+
+func (l *FailureLimiter) error(err error) {
+	if l.onError != nil {
+		l.onError(err)
+	}
+}
+
+func key(kind Kind, value string) string {
+	return string(kind) + ":" + value
+}
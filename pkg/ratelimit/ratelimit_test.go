@@ -0,0 +1,176 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is advanced by the tests instead of waiting.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+type step struct {
+	// after advances the clock before the step.
+	after time.Duration
+	// op is "fail", "success" or "allow".
+	op       string
+	ip, user string
+	// banned is the kind of ban Allow must report, empty when the login is allowed.
+	banned Kind
+}
+
+func TestFailureLimiter(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		steps []step
+	}{
+		{"user locked after max failures", []step{
+			{op: "fail", ip: "ip1", user: "alice"},
+			{op: "fail", ip: "ip1", user: "alice"},
+			{op: "allow", ip: "ip1", user: "alice"},
+			{op: "fail", ip: "ip1", user: "alice"},
+			{op: "allow", ip: "ip1", user: "alice", banned: User},
+			{op: "allow", ip: "ip2", user: "alice", banned: User},
+			{op: "allow", ip: "ip1", user: "bob"},
+		}},
+		{"failures leave the window", []step{
+			{op: "fail", ip: "ip1", user: "alice"},
+			{after: 30 * time.Second, op: "fail", ip: "ip1", user: "alice"},
+			// The first failure is exactly one window old and no longer counts.
+			{after: 30 * time.Second, op: "fail", ip: "ip1", user: "alice"},
+			{op: "allow", ip: "ip1", user: "alice"},
+			{after: time.Second, op: "fail", ip: "ip1", user: "alice"},
+			{op: "allow", ip: "ip1", user: "alice", banned: User},
+		}},
+		{"IP banned across users", []step{
+			{op: "fail", ip: "ip1", user: "alice"},
+			{op: "fail", ip: "ip1", user: "bob"},
+			{op: "fail", ip: "ip1", user: "carol"},
+			{op: "allow", ip: "ip1", user: "dave"},
+			{op: "fail", ip: "ip1", user: "dave"},
+			{op: "allow", ip: "ip1", user: "erin", banned: IP},
+			{op: "allow", ip: "ip2", user: "alice"},
+		}},
+		{"success forgets the failures of the user only", []step{
+			{op: "fail", ip: "ip1", user: "alice"},
+			{op: "fail", ip: "ip1", user: "alice"},
+			{op: "success", ip: "ip1", user: "alice"},
+			{op: "fail", ip: "ip1", user: "alice"},
+			{op: "allow", ip: "ip1", user: "alice"},
+			{op: "fail", ip: "ip1", user: "bob"},
+			{op: "allow", ip: "ip1", user: "carol", banned: IP},
+		}},
+		{"user lock expires", []step{
+			{op: "fail", ip: "ip1", user: "alice"},
+			{op: "fail", ip: "ip2", user: "alice"},
+			{op: "fail", ip: "ip3", user: "alice"},
+			{after: 5*time.Minute - time.Second, op: "allow", ip: "ip1", user: "alice", banned: User},
+			{after: time.Second, op: "allow", ip: "ip1", user: "alice"},
+			// The failures that caused the lock were forgotten with it.
+			{op: "fail", ip: "ip4", user: "alice"},
+			{op: "allow", ip: "ip4", user: "alice"},
+		}},
+		{"IP ban expires", []step{
+			{op: "fail", ip: "ip1", user: "a"},
+			{op: "fail", ip: "ip1", user: "b"},
+			{op: "fail", ip: "ip1", user: "c"},
+			{op: "fail", ip: "ip1", user: "d"},
+			{after: 10*time.Minute - time.Second, op: "allow", ip: "ip1", banned: IP},
+			{after: time.Second, op: "allow", ip: "ip1"},
+		}},
+		{"empty values are not counted", []step{
+			{op: "fail", user: "alice"},
+			{op: "fail", user: "alice"},
+			{op: "fail", user: "alice"},
+			{op: "allow", ip: "ip1", user: "alice", banned: User},
+			{op: "fail", ip: "ip2"},
+			{op: "fail", ip: "ip2"},
+			{op: "fail", ip: "ip2"},
+			{op: "fail", ip: "ip2"},
+			{op: "allow", ip: "ip2", banned: IP},
+			{op: "allow", user: "bob"},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			l := New(nil,
+				WithWindow(time.Minute),
+				WithIPBan(4, 10*time.Minute),
+				WithUserLock(3, 5*time.Minute),
+				WithClock(clock.Now),
+			)
+			for i, s := range tt.steps {
+				clock.now = clock.now.Add(s.after)
+				switch s.op {
+				case "fail":
+					l.Failure(s.ip, s.user)
+				case "success":
+					l.Success(s.ip, s.user)
+				case "allow":
+					err := l.Allow(s.ip, s.user)
+					var banned *BannedError
+					switch {
+					case s.banned == "" && err != nil:
+						t.Fatalf("step %d: %v, want the login allowed", i, err)
+					case s.banned != "" && (!errors.As(err, &banned) || banned.Kind != s.banned):
+						t.Fatalf("step %d: got %v, want a %s ban", i, err, s.banned)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestFailureLimiterDisabled(t *testing.T) {
+	l := New(nil, WithIPBan(0, time.Minute), WithUserLock(0, time.Minute))
+	for i := 0; i < 20; i++ {
+		l.Failure("ip1", "alice")
+	}
+	if err := l.Allow("ip1", "alice"); err != nil {
+		t.Fatalf("disabled limits banned: %v", err)
+	}
+}
+
+func TestFailureLimiterEvents(t *testing.T) {
+	events := make(chan Event, 2)
+	l := New(nil, WithUserLock(1, 20*time.Millisecond), WithIPBan(0, 0))
+	l.Notify(func(e Event) { events <- e })
+	l.Failure("ip1", "alice")
+	for _, banned := range []bool{true, false} {
+		select {
+		case e := <-events:
+			if e.Kind != User || e.Value != "alice" || e.Banned != banned {
+				t.Fatalf("event = %+v, want banned %v", e, banned)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no event with banned %v", banned)
+		}
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s := NewMemoryStore()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := s.AddFailure("ip:a", start, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ban("ip:b", start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if until, _ := s.BannedUntil("ip:b", start); !until.Equal(start.Add(time.Minute)) {
+		t.Fatalf("ban until %v", until)
+	}
+	// Keys never seen again are dropped once a window passed.
+	if n, err := s.AddFailure("ip:c", start.Add(2*time.Minute), time.Minute); err != nil || n != 1 {
+		t.Fatalf("AddFailure = %d, %v", n, err)
+	}
+	if len(s.failures) != 1 || len(s.bans) != 0 {
+		t.Fatalf("%d failures and %d bans left after the sweep, want 1 and 0", len(s.failures), len(s.bans))
+	}
+}
@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"fmt"
+	"net"
 	"path/filepath"
+	"strings"
 )
 
 func AbsPath(path string) string {
@@ -13,3 +16,47 @@ func AbsPath(path string) string {
 	}
 	return path
 }
+
+// IP returns the IP address of a network address, or nil if it has none.
+func IP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// MatchCIDRs reports whether ip is contained in one of the given CIDR blocks. Plain IP
+// addresses are accepted as single host blocks.
+func MatchCIDRs(list []string, ip net.IP) (bool, error) {
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			host := net.ParseIP(entry)
+			if host == nil {
+				return false, fmt.Errorf("invalid address %q", entry)
+			}
+			if host.Equal(ip) {
+				return true, nil
+			}
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return false, err
+		}
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -1,8 +1,8 @@
 package sftp
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
@@ -12,17 +12,23 @@ import (
 	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"slices"
+	"strconv"
+	"sync"
 	"time"
 	
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	
+	"github.com/oarkflow/sftp/pkg/errs"
 	"github.com/oarkflow/sftp/pkg/fs"
 	"github.com/oarkflow/sftp/pkg/log"
 	"github.com/oarkflow/sftp/pkg/log/oarklog"
 	"github.com/oarkflow/sftp/pkg/models"
+	"github.com/oarkflow/sftp/pkg/otp"
 	providers2 "github.com/oarkflow/sftp/pkg/providers"
+	"github.com/oarkflow/sftp/pkg/ratelimit"
 	"github.com/oarkflow/sftp/pkg/utils"
 )
 
@@ -31,14 +37,41 @@ type Server struct {
 	userProvider         providers2.UserProvider
 	logger               log.Logger
 	credentialValidator  func(server *Server, r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error)
+	publicKeyValidator   func(server *Server, r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error)
+	certChecker          *ssh.CertChecker
+	rateLimiter          ratelimit.Limiter
+	totp                 otp.Verifier
+	sshConfig            *ssh.ServerConfig
+	hostSigners          []ssh.Signer
+	hostKeyAlgorithms    hostKeyAlgorithms
+	sessions             map[net.Conn]*session
+	lastSessionID        uint64
+	listeners            map[net.Listener]struct{}
+	mu                   sync.RWMutex
 	notificationCallback NotificationHandler
 	basePath             string
 	sshPath              string
 	privateKey           string
 	publicKey            string
+	hostCertificate      string
+	revocationList       string
+	userCAKeys           []string
+	allowedIPs           []string
+	deniedIPs            []string
+	hostKeys             []string
 	address              string
 	port                 int
+	maxConnections       int
+	maxConnectionsPerIP  int
+	maxSessionsPerUser   int
+	handshakeTimeout     time.Duration
+	idleTimeout          time.Duration
+	expiryWarning        time.Duration
+	homeDirectory        string
+	skeletonDir          string
+	homeMu               sync.Mutex
 	notify               bool
+	inShutdown           bool
 }
 
 func defaultServer() *Server {
@@ -55,8 +88,21 @@ func defaultServer() *Server {
 		notify:       true,
 		userProvider: userProvider,
 		credentialValidator: func(server *Server, r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error) {
+			if auth, ok := server.userProvider.(providers2.RequestAuthenticator); ok {
+				return auth.Authenticate(r)
+			}
 			return server.userProvider.Login(r.User, r.Pass)
 		},
+		publicKeyValidator: func(server *Server, r fs.AuthenticationRequest) (*fs.AuthenticationResponse, error) {
+			if auth, ok := server.userProvider.(providers2.RequestAuthenticator); ok {
+				return auth.Authenticate(r)
+			}
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.PublicKey))
+			if err != nil {
+				return nil, err
+			}
+			return providers2.LoginWithKey(server.userProvider, r.User, key)
+		},
 	}
 }
 
@@ -78,67 +124,171 @@ func newServer(svr *Server, opts ...func(*Server)) *Server {
 	return svr
 }
 
-func (c *Server) AddUser(user models.User) {
+// AddUser creates a user when the provider is a providers.UserStore and registers it
+// otherwise, in which case errors cannot be reported.
+func (c *Server) AddUser(user models.User) error {
+	if store, ok := c.userProvider.(providers2.UserStore); ok {
+		return store.Create(user)
+	}
 	c.userProvider.Register(user)
+	return nil
 }
 
+// Validate authenticates a password login against the configured credential validator.
+// Users that require a second factor after a password continue with keyboard-interactive.
 func (c *Server) Validate(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	r := newAuthenticationRequest(conn)
+	r.Pass = string(pass)
+	resp, err := c.authenticate(conn, true, func() (*fs.AuthenticationResponse, error) {
+		return c.credentialValidator(c, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.passwordLogin(conn, resp)
+}
+
+// ValidatePublicKey authenticates a public key login against the configured public key validator.
+// The resulting permissions are identical to the ones produced by Validate.
+// User certificates are checked against the trusted certificate authorities instead.
+func (c *Server) ValidatePublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return c.validateCertificate(conn, cert)
+	}
+	r := newAuthenticationRequest(conn)
+	r.PublicKey = string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key)))
+	// Clients offer all their keys in turn, so rejected keys are not counted right away.
+	resp, err := c.authenticate(conn, false, func() (*fs.AuthenticationResponse, error) {
+		resp, err := c.publicKeyValidator(c, r)
+		if err != nil {
+			c.keyFailed(conn)
+		}
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.secondFactor(conn, "publickey", resp)
+}
+
+// authenticate runs a first factor check unless the client IP or the user is banned, or the
+// client IP is not allowed for the server. The lists of the user are checked once the check
+// succeeded, with the user it returned, so failed attempts never cost a user lookup. Failed
+// checks are recorded by the rate limiter when countFailure is set.
+func (c *Server) authenticate(conn ssh.ConnMetadata, countFailure bool, check func() (*fs.AuthenticationResponse, error)) (*fs.AuthenticationResponse, error) {
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.Allow(utils.IP(conn.RemoteAddr()).String(), conn.User()); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkSourceIP(conn, nil); err != nil {
+		return nil, err
+	}
+	resp, err := check()
+	if err != nil {
+		if countFailure {
+			c.authFailed(conn)
+		}
+		return nil, err
+	}
+	if err := c.checkSourceIP(conn, &resp.User); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func newAuthenticationRequest(conn ssh.ConnMetadata) fs.AuthenticationRequest {
+	return fs.AuthenticationRequest{
+		User:          conn.User(),
+		IP:            conn.RemoteAddr().String(),
+		SessionID:     conn.SessionID(),
+		ClientVersion: conn.ClientVersion(),
+	}
+}
+
+// permissions builds the ssh.Permissions for an authenticated user. The extensions are
+// later consumed by createHandler to build the user filesystem.
+func (c *Server) permissions(conn ssh.ConnMetadata, resp *fs.AuthenticationResponse) (*ssh.Permissions, error) {
 	now := time.Now().UTC()
 	nowString := now.Format(time.RFC3339)
 	user := conn.User()
 	clientVersion := string(conn.ClientVersion())
 	remoteAddr := conn.RemoteAddr().String()
-	sessionID := conn.SessionID()
-	resp, err := c.credentialValidator(c, fs.AuthenticationRequest{
-		User:          user,
-		Pass:          string(pass),
-		IP:            remoteAddr,
-		SessionID:     sessionID,
-		ClientVersion: conn.ClientVersion(),
-	})
-	
-	if err != nil {
+	if err := resp.User.CheckStatus(now); err != nil {
+		c.loginFailed(user, remoteAddr, clientVersion, err)
 		return nil, err
 	}
+	c.warnExpiry(conn, resp, now)
+	if err := c.reserveUserSession(conn, user, resp.User.MaxSessions); err != nil {
+		c.loginFailed(user, remoteAddr, clientVersion, err)
+		return nil, err
+	}
+	if c.rateLimiter != nil {
+		c.rateLimiter.Success(utils.IP(conn.RemoteAddr()).String(), user)
+	}
 	fst, err := resp.User.GetFilesystem()
 	if err != nil {
 		return nil, err
 	}
+	home := models.HomeData{ID: resp.User.ID, Username: user}
+	if fst != nil {
+		// Templated parameters such as "/srv/sftp/{{.Username}}" are resolved once per login.
+		if fst, err = fst.Expand(home); err != nil {
+			c.loginFailed(user, remoteAddr, clientVersion, err)
+			return nil, err
+		}
+	}
+	mounted := resp.User.Mounts()
+	for i, m := range mounted {
+		if mounted[i], err = m.Expand(home); err != nil {
+			c.loginFailed(user, remoteAddr, clientVersion, err)
+			return nil, err
+		}
+	}
 	useDefaultFS := "false"
-	var filesystem string
+	var filesystem, mounts, fsType string
 	if fst != nil {
 		fsBytes, err := json.Marshal(fst)
 		if err != nil {
 			return nil, err
 		}
 		filesystem = string(fsBytes)
-	} else {
+		fsType = fst.Fs
+	} else if len(mounted) == 0 {
 		useDefaultFS = "true"
 	}
+	if len(mounted) > 0 {
+		mountBytes, err := json.Marshal(mounted)
+		if err != nil {
+			return nil, err
+		}
+		mounts = string(mountBytes)
+		fsType = "mount"
+	}
 	c.logger.Info("User Authenticated",
 		"user", user,
 		"login_at", nowString,
 		"event", "Login",
 		"remote_addr", remoteAddr,
 		"client_version", clientVersion,
-		"fs_type", fst.Fs,
+		"fs_type", fsType,
 	)
-	if c.notify && c.notificationCallback != nil {
-		c.notificationCallback(Notification{
-			User:          user,
-			ClientVersion: clientVersion,
-			RemoteAddr:    remoteAddr,
-			Time:          now,
-			Event:         "Login",
-			FsType:        fst.Fs,
-		})
-	}
+	c.notifyEvent(Notification{
+		User:          user,
+		ClientVersion: clientVersion,
+		RemoteAddr:    remoteAddr,
+		Time:          now,
+		Event:         "Login",
+		FsType:        fsType,
+	})
 	sshPerm := &ssh.Permissions{
 		Extensions: map[string]string{
 			"uuid":           resp.Server,
 			"user":           user,
+			"user_id":        strconv.FormatInt(resp.User.ID, 10),
 			"remote_addr":    remoteAddr,
 			"filesystem":     filesystem,
+			"mounts":         mounts,
 			"default_fs":     useDefaultFS,
 			"client_version": clientVersion,
 			"login_at":       nowString,
@@ -149,35 +299,52 @@ func (c *Server) Validate(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions,
 
 // Initialize the SFTP server and add a persistent listener to handle inbound SFTP connections.
 func (c *Server) Initialize() error {
-	config, err := c.setupSSH()
-	if err != nil {
+	if _, err := c.setupSSH(); err != nil {
 		return err
 	}
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.address, c.port))
 	if err != nil {
 		return err
 	}
-	
-	c.logger.Info("Listening connections", "host", c.address, "port", c.port)
-	
-	for {
-		conn, _ := listener.Accept()
-		if conn != nil {
-			go c.AcceptInboundConnection(conn, config)
-		}
-	}
+	return c.Serve(context.Background(), listener)
 }
 
 // AcceptInboundConnection ... Handles an inbound connection to the instance and determines if
 // we should serve the request or not.
 func (c *Server) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig) {
 	defer conn.Close()
-	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	sess, err := c.trackSession(conn)
 	if err != nil {
+		if !errors.Is(err, ErrServerClosed) {
+			c.rejectConn(conn, err)
+		}
+		return
+	}
+	defer c.untrackSession(sess)
+	if c.rateLimiter != nil {
+		if err := c.rateLimiter.Allow(utils.IP(conn.RemoteAddr()).String(), ""); err != nil {
+			c.rejectConn(conn, err)
+			return
+		}
+	}
+	if allowed, _ := models.IPAllowed(utils.IP(conn.RemoteAddr()), c.allowedIPs, c.deniedIPs); !allowed {
+		c.rejectConn(conn, errs.IPNotAllowedError{IP: utils.IP(conn.RemoteAddr()).String()})
+		return
+	}
+	if c.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.handshakeTimeout))
+	}
+	sconn, chans, reqs, err := ssh.NewServerConn(sessionConn{Conn: conn, addr: sessionAddr{Addr: conn.RemoteAddr(), id: sess.id}}, config)
+	if err != nil {
+		c.keyFailures(sess)
 		return
 	}
 	defer sconn.Close()
-	go ssh.DiscardRequests(reqs)
+	conn.SetDeadline(time.Time{})
+	c.setSessionConn(sess, sconn)
+	c.watchIdle(sess, sconn)
+	go c.handleGlobalRequests(sconn, reqs, c.hostKeyAlgorithms.take(sconn.SessionID()))
+	go c.announceHostKeys(sconn)
 	for newChannel := range chans {
 		if newChannel.ChannelType() != "session" {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
@@ -202,13 +369,14 @@ func (c *Server) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig
 		if sconn.Permissions.Extensions["uuid"] == "" {
 			continue
 		}
-		handlers, err := c.createHandler(sconn)
+		handlers, err := c.createHandler(sconn, sess)
 		if err != nil {
+			c.logger.Error("failed to create the user filesystem", "user", sconn.User(), "err", err)
 			newChannel.Reject(ssh.ConnectionFailed, err.Error())
 			channel.Close()
 			return
 		}
-		server := sftp.NewRequestServer(channel, handlers)
+		server := sftp.NewRequestServer(activityChannel{Channel: channel, session: sess}, handlers)
 		if err := server.Serve(); err == io.EOF {
 			server.Close()
 		}
@@ -218,7 +386,7 @@ func (c *Server) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig
 // Creates a new SFTP handler for a given server. The directory argument should
 // be the base directory for a server. All actions done on the server will be
 // relative to that directory, and the user will not be able to escape out of it.
-func (c *Server) createHandler(sconn *ssh.ServerConn) (sftp.Handlers, error) {
+func (c *Server) createHandler(sconn *ssh.ServerConn, sess *session) (sftp.Handlers, error) {
 	fst, err := c.getUserFilesystem(sconn, c.basePath)
 	if err != nil {
 		return sftp.Handlers{}, err
@@ -229,75 +397,81 @@ func (c *Server) createHandler(sconn *ssh.ServerConn) (sftp.Handlers, error) {
 	ext := sconn.Permissions.Extensions
 	ctx := make(map[string]string)
 	for key, val := range ext {
-		if !slices.Contains([]string{"filesystem", "default_fs", "server_version", "login_at", "uuid"}, key) {
+		if !slices.Contains([]string{"filesystem", "mounts", "default_fs", "server_version", "login_at", "uuid"}, key) {
 			ctx[key] = val
 		}
 	}
 	fst.SetConn(sconn)
 	fst.SetContext(ctx)
 	fst.SetID(ext["uuid"])
-	return sftp.Handlers{FileGet: fst, FilePut: fst, FileCmd: fst, FileList: fst}, nil
+	tracker := &transferTracker{reader: fst, writer: fst, session: sess}
+	return sftp.Handlers{FileGet: tracker, FilePut: tracker, FileCmd: fst, FileList: fst}, nil
 }
 
 func (c *Server) getSSHPath(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
 	return path.Join(c.basePath, c.sshPath, file)
 }
 
 func (c *Server) setupSSH() (*ssh.ServerConfig, error) {
-	config := &ssh.ServerConfig{
-		NoClientAuth:     false,
-		MaxAuthTries:     6,
-		PasswordCallback: c.Validate,
-	}
-	if _, err := os.Stat(c.getSSHPath(c.privateKey)); os.IsNotExist(err) {
-		if err := c.generatePrivateKey(); err != nil {
-			return nil, err
-		}
-	} else if err != nil {
+	if err := c.validateIPLists(); err != nil {
 		return nil, err
 	}
-	
-	privateBytes, err := os.ReadFile(c.getSSHPath(c.privateKey))
+	var err error
+	c.certChecker, err = c.setupCertChecker()
 	if err != nil {
 		return nil, err
 	}
-	
-	private, err := ssh.ParsePrivateKey(privateBytes)
+	signers, err := c.loadHostKeys(c.hostKeyFiles())
 	if err != nil {
 		return nil, err
 	}
-	
-	// Add our private key to the server configuration.
-	config.AddHostKey(private)
-	/*err = c.generatePublicKey(privateBytes)
+	config, err := c.newSSHConfig(signers)
 	if err != nil {
 		return nil, err
-	}*/
+	}
+	c.mu.Lock()
+	c.sshConfig = config
+	c.hostSigners = signers
+	c.mu.Unlock()
 	return config, nil
 }
 
-// Generates a private key that will be used by the SFTP server.
-func (c *Server) generatePrivateKey() error {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return err
-	}
-	
-	if err := os.MkdirAll(path.Join(c.basePath, c.sshPath), 0755); err != nil {
-		return err
+// newSSHConfig builds the configuration used for new connections with the given host keys.
+func (c *Server) newSSHConfig(signers []ssh.Signer) (*ssh.ServerConfig, error) {
+	config := &ssh.ServerConfig{
+		NoClientAuth:                false,
+		MaxAuthTries:                6,
+		PasswordCallback:            c.Validate,
+		PublicKeyCallback:           c.ValidatePublicKey,
+		KeyboardInteractiveCallback: c.ValidateKeyboardInteractive,
 	}
-	
-	o, err := os.OpenFile(c.getSSHPath(c.privateKey), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
+	// Add our private keys to the server configuration. RSA keys record the algorithm
+	// negotiated with each client to prove host keys with the same one later.
+	signers = slices.Clone(signers)
+	for i, signer := range signers {
+		if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+			signers[i] = recordingSigner{AlgorithmSigner: algorithmSigner, algorithms: &c.hostKeyAlgorithms}
+		}
+		config.AddHostKey(signers[i])
 	}
-	defer o.Close()
-	
-	pkey := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	if c.hostCertificate != "" {
+		certSigner, err := c.loadHostCertificate(signers)
+		if err != nil {
+			return nil, err
+		}
+		config.AddHostKey(certSigner)
 	}
-	return pem.Encode(o, pkey)
+	return config, nil
+}
+
+// serverConfig returns the configuration to use for a new connection.
+func (c *Server) serverConfig() *ssh.ServerConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sshConfig
 }
 
 // GetPublicKey extracts the public key from an ssh.Signer (typically a private key)
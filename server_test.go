@@ -0,0 +1,79 @@
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/models"
+	"github.com/oarkflow/sftp/pkg/providers"
+)
+
+// newTestServer serves the users with a fresh host key on a loopback port and returns its
+// address. The server is stopped with the test.
+func newTestServer(t *testing.T, users []models.User, opts ...func(*Server)) string {
+	t.Helper()
+	opts = append([]func(*Server){WithBasePath(t.TempDir()), WithHostKeys("ssh_host_ed25519_key")}, opts...)
+	srv := New(opts...)
+	for _, user := range users {
+		if err := srv.AddUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Serve(ctx, l)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return l.Addr().String()
+}
+
+// login reports whether user completes the SSH authentication with the given methods.
+func login(addr, user string, auth ...ssh.AuthMethod) error {
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func hashPassword(t *testing.T, pass string) string {
+	t.Helper()
+	hash, err := providers.HashPassword(pass, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
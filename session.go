@@ -0,0 +1,303 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrServerClosed is returned by Serve after a call to Shutdown.
+var ErrServerClosed = errors.New("sftp: server closed")
+
+// shutdownPollInterval is how often Shutdown checks for sessions without in-flight transfers.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// session is an inbound connection tracked by the server.
+type session struct {
+	// id identifies the session in the authentication callbacks, see sessionAddr.
+	id   uint64
+	conn net.Conn
+	// sconn is nil until the SSH handshake completed.
+	sconn *ssh.ServerConn
+	// user is the login name once authenticated.
+	user string
+	// keyRejected is the login name a public key or certificate was rejected for.
+	keyRejected string
+	// transfers is the number of open file handles, i.e. uploads and downloads in progress.
+	transfers atomic.Int64
+	// lastActivity is the time of the last packet received, in Unix nanoseconds.
+	lastActivity atomic.Int64
+}
+
+func (s *session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (s *session) lastSeen() time.Time {
+	return time.Unix(0, s.lastActivity.Load())
+}
+
+func (s *session) idle() bool {
+	return s.transfers.Load() == 0
+}
+
+// Serve accepts connections on the listener and serves them until the listener fails, ctx is
+// cancelled or Shutdown is called. Cancelling ctx only stops accepting new connections, call
+// Shutdown to end the sessions in progress. Serve always returns a non-nil error, after
+// Shutdown it is ErrServerClosed.
+func (c *Server) Serve(ctx context.Context, listener net.Listener) error {
+	if c.serverConfig() == nil {
+		if _, err := c.setupSSH(); err != nil {
+			return err
+		}
+	}
+	if !c.trackListener(listener, true) {
+		return ErrServerClosed
+	}
+	defer c.trackListener(listener, false)
+	stop := context.AfterFunc(ctx, func() {
+		listener.Close()
+	})
+	defer stop()
+
+	c.logger.Info("Listening connections", "address", listener.Addr().String())
+
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if c.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// Most other accept errors are transient, e.g. running out of file descriptors.
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			c.logger.Error("failed to accept connection", "err", err, "retry_in", backoff.String())
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		go c.AcceptInboundConnection(conn, c.serverConfig())
+	}
+}
+
+// Shutdown gracefully stops the server. It closes all listeners, then closes every session as
+// soon as it has no upload or download in progress. When ctx expires before all sessions
+// ended, the remaining ones are closed forcefully and the context error is returned.
+func (c *Server) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.inShutdown = true
+	for listener := range c.listeners {
+		listener.Close()
+	}
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if c.closeSessions(false) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			c.closeSessions(true)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeSessions closes idle sessions, or all of them when force is set, and returns how many
+// sessions are still open.
+func (c *Server) closeSessions(force bool) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	remaining := 0
+	for _, s := range c.sessions {
+		if force || s.idle() {
+			s.conn.Close()
+		}
+		remaining++
+	}
+	return remaining
+}
+
+func (c *Server) shuttingDown() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.inShutdown
+}
+
+func (c *Server) trackListener(listener net.Listener, add bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !add {
+		delete(c.listeners, listener)
+		return true
+	}
+	if c.inShutdown {
+		return false
+	}
+	if c.listeners == nil {
+		c.listeners = make(map[net.Listener]struct{})
+	}
+	c.listeners[listener] = struct{}{}
+	return true
+}
+
+// trackSession registers a new inbound connection. It returns an error once the server is
+// shutting down or when a connection limit is reached.
+func (c *Server) trackSession(conn net.Conn) (*session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inShutdown {
+		return nil, ErrServerClosed
+	}
+	if err := c.admitConn(conn); err != nil {
+		return nil, err
+	}
+	if c.sessions == nil {
+		c.sessions = make(map[net.Conn]*session)
+	}
+	c.lastSessionID++
+	s := &session{id: c.lastSessionID, conn: conn}
+	c.sessions[conn] = s
+	return s, nil
+}
+
+// sessionAddr is the remote address of a tracked connection as seen by the SSH layer. The
+// authentication callbacks only get the connection metadata, the address carries the ID of
+// the session they belong to.
+type sessionAddr struct {
+	net.Addr
+	id uint64
+}
+
+// sessionConn reports the remote address of conn as a sessionAddr.
+type sessionConn struct {
+	net.Conn
+	addr sessionAddr
+}
+
+func (s sessionConn) RemoteAddr() net.Addr {
+	return s.addr
+}
+
+// connSession returns the tracked session of an authenticating connection. It must be called
+// with the server lock held.
+func (c *Server) connSession(conn ssh.ConnMetadata) *session {
+	addr, ok := conn.RemoteAddr().(sessionAddr)
+	if !ok {
+		return nil
+	}
+	for _, s := range c.sessions {
+		if s.id == addr.id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (c *Server) untrackSession(s *session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sessions, s.conn)
+}
+
+func (c *Server) setSessionConn(s *session, sconn *ssh.ServerConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s.sconn = sconn
+}
+
+// transferTracker counts the file handles opened through a session so Shutdown can wait for
+// transfers to complete.
+type transferTracker struct {
+	reader  sftp.FileReader
+	writer  sftp.FileWriter
+	session *session
+}
+
+func (t *transferTracker) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	rs, err := t.reader.Fileread(request)
+	if err != nil {
+		return rs, err
+	}
+	t.session.transfers.Add(1)
+	return &trackedReader{ReaderAt: rs, done: t.done()}, nil
+}
+
+func (t *transferTracker) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	rs, err := t.writer.Filewrite(request)
+	if err != nil {
+		return rs, err
+	}
+	t.session.transfers.Add(1)
+	return &trackedWriter{WriterAt: rs, done: t.done()}, nil
+}
+
+func (t *transferTracker) done() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.session.transfers.Add(-1)
+		})
+	}
+}
+
+type trackedReader struct {
+	io.ReaderAt
+	done func()
+}
+
+func (r *trackedReader) Close() error {
+	defer r.done()
+	return closeHandle(r.ReaderAt)
+}
+
+func (r *trackedReader) TransferError(err error) {
+	transferError(r.ReaderAt, err)
+}
+
+type trackedWriter struct {
+	io.WriterAt
+	done func()
+}
+
+func (w *trackedWriter) Close() error {
+	defer w.done()
+	return closeHandle(w.WriterAt)
+}
+
+func (w *trackedWriter) TransferError(err error) {
+	transferError(w.WriterAt, err)
+}
+
+func closeHandle(handle any) error {
+	if closer, ok := handle.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func transferError(handle any, err error) {
+	if t, ok := handle.(sftp.TransferError); ok {
+		t.TransferError(err)
+	}
+}
@@ -0,0 +1,98 @@
+package sftp
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/errs"
+	"github.com/oarkflow/sftp/pkg/fs"
+	"github.com/oarkflow/sftp/pkg/models"
+)
+
+// ValidateKeyboardInteractive authenticates a keyboard-interactive login. The client is asked
+// for the password, for a new one if it expired and, if the user has a TOTP secret enrolled,
+// for a verification code.
+func (c *Server) ValidateKeyboardInteractive(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	answers, err := client("", "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, errs.InvalidCredentialsError{}
+	}
+	r := newAuthenticationRequest(conn)
+	r.Pass = answers[0]
+	resp, err := c.authenticate(conn, true, func() (*fs.AuthenticationResponse, error) {
+		return c.credentialValidator(c, r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.allowMethod(conn, "password", resp.User); err != nil {
+		return nil, err
+	}
+	if resp.User.PasswordExpired(time.Now()) {
+		if err := c.changePassword(conn, resp, client); err != nil {
+			return nil, err
+		}
+	}
+	if resp.User.RequiresTOTP("password") || resp.User.TOTPSecret() != "" {
+		if err := c.challengeTOTP(conn, resp.User, client); err != nil {
+			return nil, err
+		}
+	}
+	return c.permissions(conn, resp)
+}
+
+// allowMethod rejects a first factor that the two-factor mode of the user does not accept,
+// e.g. a password for a user that must log in with a public key and a TOTP code.
+func (c *Server) allowMethod(conn ssh.ConnMetadata, method string, user models.User) error {
+	if user.AllowsMethod(method) {
+		return nil
+	}
+	err := fmt.Errorf("two-factor mode %s does not accept %s logins", user.TwoFactor, method)
+	c.loginFailed(conn.User(), conn.RemoteAddr().String(), string(conn.ClientVersion()), err)
+	return err
+}
+
+// secondFactor finishes a login that passed its first factor. If the user requires a TOTP
+// code after the given method, the client is told through a partial success that it must
+// continue with keyboard-interactive authentication.
+func (c *Server) secondFactor(conn ssh.ConnMetadata, method string, resp *fs.AuthenticationResponse) (*ssh.Permissions, error) {
+	if err := c.allowMethod(conn, method, resp.User); err != nil {
+		return nil, err
+	}
+	if !resp.User.RequiresTOTP(method) {
+		return c.permissions(conn, resp)
+	}
+	return nil, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				if err := c.challengeTOTP(conn, resp.User, client); err != nil {
+					return nil, err
+				}
+				return c.permissions(conn, resp)
+			},
+		},
+	}
+}
+
+// challengeTOTP asks the client for a verification code and checks it against the user secret.
+func (c *Server) challengeTOTP(conn ssh.ConnMetadata, user models.User, client ssh.KeyboardInteractiveChallenge) error {
+	secret := user.TOTPSecret()
+	if secret == "" {
+		c.logger.Warn("two-factor authentication required but no secret enrolled", "user", user.Username)
+		return errs.InvalidCredentialsError{}
+	}
+	answers, err := client("", "Two-factor authentication", []string{"Verification code: "}, []bool{false})
+	if err != nil {
+		return err
+	}
+	if len(answers) != 1 || !c.totp.Validate(user.Username, answers[0], secret, time.Now()) {
+		c.authFailed(conn)
+		return errs.InvalidCredentialsError{}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package sftp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/oarkflow/sftp/pkg/models"
+	"github.com/oarkflow/sftp/pkg/otp"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// answer replies to the keyboard-interactive prompts with the password and the TOTP code.
+func answer(pass, code string) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			if strings.Contains(q, "code") {
+				answers[i] = code
+			} else {
+				answers[i] = pass
+			}
+		}
+		return answers, nil
+	})
+}
+
+func TestTwoFactorModes(t *testing.T) {
+	signer := newTestSigner(t)
+	user := func(name string, mode models.TwoFactorMode) models.User {
+		return models.User{
+			Username:    name,
+			Password:    hashPassword(t, "secret"),
+			PublicKeys:  []string{string(ssh.MarshalAuthorizedKey(signer.PublicKey()))},
+			Permissions: []string{"read"},
+			TwoFactor:   mode,
+			Credentials: []models.Credential{
+				{Credential: testTOTPSecret, CredentialType: models.TwoFactor, Integration: models.SFTP},
+			},
+		}
+	}
+	var users []models.User
+	for _, name := range []string{"pw", "pw-ki", "pw-wrong", "pw-key", "key", "key-pw", "key-ki", "any", "any-key"} {
+		mode := models.TwoFactorPassword
+		switch {
+		case strings.HasPrefix(name, "key"):
+			mode = models.TwoFactorPublicKey
+		case strings.HasPrefix(name, "any"):
+			mode = models.TwoFactorAny
+		}
+		users = append(users, user(name, mode))
+	}
+	addr := newTestServer(t, users)
+	code, err := otp.Generate(testTOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every successful login uses another user, codes are accepted once per user.
+	for _, tt := range []struct {
+		name string
+		user string
+		auth []ssh.AuthMethod
+		ok   bool
+	}{
+		{"password and code", "pw", []ssh.AuthMethod{ssh.Password("secret"), answer("", code)}, true},
+		{"keyboard-interactive password and code", "pw-ki", []ssh.AuthMethod{answer("secret", code)}, true},
+		{"password and wrong code", "pw-wrong", []ssh.AuthMethod{ssh.Password("secret"), answer("", "000000")}, false},
+		{"password without code", "pw-wrong", []ssh.AuthMethod{ssh.Password("secret")}, false},
+		{"public key of a password user", "pw-key", []ssh.AuthMethod{ssh.PublicKeys(signer), answer("", code)}, false},
+		{"public key and code", "key", []ssh.AuthMethod{ssh.PublicKeys(signer), answer("", code)}, true},
+		{"public key without code", "key-pw", []ssh.AuthMethod{ssh.PublicKeys(signer)}, false},
+		{"password of a public key user", "key-pw", []ssh.AuthMethod{ssh.Password("secret"), answer("", code)}, false},
+		{"keyboard-interactive of a public key user", "key-ki", []ssh.AuthMethod{answer("secret", code)}, false},
+		{"any with password", "any", []ssh.AuthMethod{ssh.Password("secret"), answer("", code)}, true},
+		{"any with public key", "any-key", []ssh.AuthMethod{ssh.PublicKeys(signer), answer("", code)}, true},
+		{"replayed code", "pw", []ssh.AuthMethod{ssh.Password("secret"), answer("", code)}, false},
+	} {
+		err := login(addr, tt.user, tt.auth...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: login error %v, want success %v", tt.name, err, tt.ok)
+		}
+	}
+}